@@ -132,7 +132,7 @@ class Chat extends React.Component<Props, State> {
 
           this.setUserConfig(userConfig);
           this.setState({userConfig: userConfig});
-          this.addNotiMessage(`Set name successfully to ${userConfig.name}`);
+          this.addNotiMessage(`Set name successfully to ${userConfig.name}. Rooms you already chatted in keep your old name`);
 
         } else {
           this.addNotiMessage("Invalid command");
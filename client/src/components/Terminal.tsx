@@ -17,12 +17,14 @@ interface Props {
   width: number; // in pixel
   height: number; // in pixel
   delay?: number;
+  control?: boolean; // viewer has control of streamer's shell
   className?: string;
 }
 
-const Terminal: React.FC<Props> = ({ msgManager, width = -1, height = -1, delay = 0, className = ""}: Props) => {
+const Terminal: React.FC<Props> = ({ msgManager, width = -1, height = -1, delay = 0, control = false, className = ""}: Props) => {
   const termRef = useRef<Xterm>(null);
   const divRef = useRef<HTMLDivElement>(null);
+  const [paused, setPaused] = useState(false);
 
   const rescale = () => {
     if (termRef.current && divRef.current && (width! > 0 || height! > 0)) {
@@ -59,7 +61,11 @@ const Terminal: React.FC<Props> = ({ msgManager, width = -1, height = -1, delay
       rescale();
     }
 
-    const writeManager = new WriteManager(writeCB, winsizeCB, delay);
+    const pauseCB = (pause: message.Pause) => {
+      setPaused(pause.Paused);
+    }
+
+    const writeManager = new WriteManager(writeCB, winsizeCB, pauseCB, delay);
 
     msgManager.pub("request", constants.MSG_TREQUEST_CACHE_CONTENT);
     msgManager.pub("request", constants.MSG_TREQUEST_WINSIZE);
@@ -73,13 +79,34 @@ const Terminal: React.FC<Props> = ({ msgManager, width = -1, height = -1, delay
       rescale();
     })
 
+    // messages of direct mode are rendered right away
+    msgManager.sub(constants.MSG_TWRITE, (data: string) => {
+      writeCB(buffer.str2ab(data));
+    });
+
+    msgManager.sub(constants.MSG_TSNAPSHOT, (snapshot: message.Snapshot) => {
+      winsizeCB({Rows: snapshot.Rows, Cols: snapshot.Cols});
+      writeCB(buffer.str2ab(snapshot.Data));
+    });
+
+    msgManager.sub(constants.MSG_TPAUSE, pauseCB);
+
     return () => {
       msgManager.unsub(constants.MSG_TWRITEBLOCK);
       msgManager.unsub(constants.MSG_TWINSIZE);
+      msgManager.unsub(constants.MSG_TWRITE);
+      msgManager.unsub(constants.MSG_TSNAPSHOT);
+      msgManager.unsub(constants.MSG_TPAUSE);
     }
 
   }, [msgManager]);
 
+  // collaborators type right into the terminal
+  useEffect(() => {
+    termRef.current?.terminal.setOption('disableStdin', !control);
+    if (control) termRef.current?.terminal.focus();
+  }, [control]);
+
   // handle when resize is requried
   useEffect(() => {
     const handleResize = () => { 
@@ -99,7 +126,11 @@ const Terminal: React.FC<Props> = ({ msgManager, width = -1, height = -1, delay
   return (
     <div className={`relative ${className} overflow-hidden`}
       style={{width: width!, height: height!}}>
-      <div className="overlay bg-transparent absolute top-0 left-0 z-10 w-full h-full"></div>
+      {!control && <div className="overlay bg-transparent absolute top-0 left-0 z-10 w-full h-full"></div>}
+      {paused &&
+        <div className="absolute top-0 left-0 z-20 w-full h-full bg-black flex justify-center items-center">
+          <p className="text-2xl font-bold">⏸ Streamer is away, be right back</p>
+        </div>}
       <div ref={divRef}
         className="divref absolute top-1/2 left-1/2 origin-top-left transform -translate-x-1/2 -translate-y-1/2 overflow-hidden">
         <Xterm
@@ -107,6 +138,9 @@ const Terminal: React.FC<Props> = ({ msgManager, width = -1, height = -1, delay
             rightClickSelectsWord: false,
               disableStdin: true,
           }}
+          onData={(data: string) => {
+            if (control) msgManager.pub(constants.MSG_TINPUT, data);
+          }}
           ref={termRef}/>
       </div>
     </div>
@@ -118,11 +152,13 @@ class WriteManager {
   queue: message.Wrapper[] = [];
   writeCB: (arr:Uint8Array) => void;
   winsizeCB: (ws:Winsize) => void;
+  pauseCB: (pause: message.Pause) => void;
   delay: number; // in milliseconds
 
-  constructor(writeCB: (arr: Uint8Array) => void, winsizeCB: (ws: Winsize) => void, delay: number = 0) {
+  constructor(writeCB: (arr: Uint8Array) => void, winsizeCB: (ws: Winsize) => void, pauseCB: (pause: message.Pause) => void, delay: number = 0) {
     this.writeCB = writeCB;
     this.winsizeCB = winsizeCB;
+    this.pauseCB = pauseCB;
     this.delay = delay;
   }
 
@@ -161,6 +197,17 @@ class WriteManager {
               this.winsizeCB(msg.Data);
               break;
 
+            case constants.MSG_TSNAPSHOT:
+              // snapshot redraws the whole screen so previous buffers are irrelevant
+              bufferArray = [];
+              this.winsizeCB({Rows: msg.Data.Rows, Cols: msg.Data.Cols});
+              bufferArray.push(buffer.str2ab(msg.Data.Data));
+              break;
+
+            case constants.MSG_TPAUSE:
+              this.pauseCB(msg.Data);
+              break;
+
             default:
               console.error("Unhandled message type: ", msg.Type);
           }
@@ -185,6 +232,19 @@ class WriteManager {
             setTimeout(() => this.winsizeCB(msg.Data), msg.Delay);
             break;
 
+          case constants.MSG_TSNAPSHOT:
+            let snapshot: message.Snapshot = msg.Data;
+            let snapshotData = buffer.str2ab(snapshot.Data);
+            setTimeout(() => {
+              this.winsizeCB({Rows: snapshot.Rows, Cols: snapshot.Cols});
+              this.writeCB(snapshotData);
+            }, msg.Delay);
+            break;
+
+          case constants.MSG_TPAUSE:
+            setTimeout(() => this.pauseCB(msg.Data), msg.Delay);
+            break;
+
           default:
             console.error("Unhandled message type: ", msg.Type);
         }
@@ -207,7 +267,7 @@ class WriteManager {
     // Since we have to : reduce message size by usign gzip and also
     // every single termwrite have to be decoded, or else the rendering will screw up
     // the whole block often took 9-20 milliseconds to decode a 3 seconds block of message
-    let data = pako.ungzip(buffer.str2ab(block.Data));
+    let data = pako.ungzip(typeof block.Data === "string" ? buffer.str2ab(block.Data) : block.Data);
     let msgArrayString: string[] = JSON.parse(buffer.ab2str(data));
 
     let msgArray: message.Wrapper[] = [];
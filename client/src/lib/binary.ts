@@ -0,0 +1,39 @@
+import * as message from "../types/message";
+import * as constants from "./constants";
+
+// Decode a binary frame from server, see pkg/message/binary.go for the layout
+export const BINARY_VERSION = 1;
+
+// 64-bit integers are read as two halves, safe up to 2^53
+function getUint64(view: DataView, offset: number): number {
+  return view.getUint32(offset) * 2 ** 32 + view.getUint32(offset + 4);
+}
+
+function getInt64(view: DataView, offset: number): number {
+  return view.getInt32(offset) * 2 ** 32 + view.getUint32(offset + 4);
+}
+
+export function decode(frame: ArrayBuffer): message.Wrapper {
+  const view = new DataView(frame);
+  if (view.getUint8(0) !== BINARY_VERSION) throw new Error(`Unsupported binary version: ${view.getUint8(0)}`);
+
+  const n = view.getUint8(1);
+  const type = new TextDecoder().decode(new Uint8Array(frame, 2, n));
+  const seq = getUint64(view, 2 + n);
+  const delay = getInt64(view, 2 + n + 8);
+  const offset = 2 + n + 16;
+
+  let data: any;
+  if (type === constants.MSG_TWRITEBLOCK) {
+    const block: message.TermWriteBlock = {
+      StartTime: new Date(getInt64(view, offset)).toISOString(),
+      Duration: getInt64(view, offset + 8),
+      Data: new Uint8Array(frame, offset + 16),
+    };
+    data = block;
+  } else {
+    data = JSON.parse(new TextDecoder().decode(new Uint8Array(frame, offset)));
+  }
+
+  return { Type: type, Data: data, Delay: delay, Seq: seq };
+}
@@ -8,6 +8,12 @@ export function str2ab(input:string): Uint8Array{
   return bytes;
 }
 
+export function ab2base64(buf: Uint8Array): string{
+  let binary_string = "";
+  buf.forEach((b) => { binary_string += String.fromCharCode(b); });
+  return window.btoa(binary_string);
+}
+
 export function ab2str(buf: any): string{
   return new TextDecoder().decode(buf);
 }
@@ -2,6 +2,7 @@
 export const MSG_TWRITE = "Write";
 export const MSG_TWRITEBLOCK = "WriteBlock";
 export const MSG_TWINSIZE = "Winsize";
+export const MSG_TSNAPSHOT = "Snapshot";
 export const MSG_TROOM_INFO = "RoomInfo";
 export const MSG_TCHAT = "Chat";
 export const MSG_TRTC = "RTC";
@@ -15,10 +16,26 @@ export const MSG_TREQUEST_ROOM_INFO = "RequestRoomInfo";
 export const MSG_TREQUEST_CACHE_CHAT = "RequestCacheChat";
 export const MSG_TAUTHORIZED = "Authorized";
 export const MSG_TUNAUTHORIZED = "Unauthorized";
+export const MSG_TINPUT = "Input"; // keystrokes sent to streamer's shell
+export const MSG_TCONTROL = "Control";
+export const MSG_TCLOSE = "Close"; // program of streamer exited
+export const MSG_TPAUSE = "Pause"; // streamer is away
+export const MSG_TPROTOCOL = "Protocol"; // protocol server negotiated with us
+export const MSG_TERROR = "Error"; // server rejected the connection
 
 export const MSG_ROLE_VIEWER = "Viewer";
 export const MSG_ROLE_RTCCONSUMER = "RTCConsumer";
 
+// Version of websocket protocol and the capabilities it has
+export const PROTOCOL_VERSION = 2;
+export const CAP_BINARY = "Binary";
+export const CAP_RESUME = "Resume";
+export const CAP_DIRECT = "Direct";
+
+// Encoding of messages server sends
+export const ENCODING_JSON = "JSON";
+export const ENCODING_BINARY = "Binary";
+
 // Message field
 export const MSG_FRTC_EVENT_OFFER = "Offer";
 export const MSG_FRTC_EVENT_ANSWER = "Answer";
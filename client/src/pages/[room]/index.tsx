@@ -4,6 +4,8 @@ import { RouteComponentProps, withRouter } from "react-router-dom";
 import * as utils from "../../utils";
 import * as constants from "../../lib/constants";
 import * as message from "../../types/message";
+import * as buffer from "../../lib/buffer";
+import * as binary from "../../lib/binary";
 import PubSub from "../../lib/pubsub";
 
 import Chat from "../../components/Chat";
@@ -24,6 +26,15 @@ const ChatWindowMinWidth: number = 400; // px
 // In verticle mode term will have in height
 const TermWindowMinHeightRatio: number = 0.6 // %
 
+const MaxReconnectTries: number = 5;
+
+// Snapshots are blocks of no duration, see SnapshotBlock in pkg/message/block.go
+function isSnapshot(msg: message.Wrapper): boolean {
+  if (msg.Type !== constants.MSG_TWRITEBLOCK) return false;
+  let block: message.TermWriteBlock = typeof msg.Data === "string" ? JSON.parse(window.atob(msg.Data)) : msg.Data;
+  return block.Duration === 0;
+}
+
 interface RectSize {
   width: number;
   height: number;
@@ -35,6 +46,7 @@ enum RoomStatus {
     Stopped = "Stopped",
     Streaming = "Streaming",
     Unauthorized = "Unauthorized",
+    Rejected = "Rejected", // server can't serve this client
 }
 
 enum Orientation {
@@ -49,6 +61,7 @@ interface RoomInfo {
   Title: string;
   Status: RoomStatus;
   Delay: number;
+  Collaborators: string[] | null;
 }
 
 interface Params {
@@ -67,6 +80,9 @@ interface State {
   connectStatus: RoomStatus;
   fullScreen: boolean | null;
   orientation: Orientation | null;
+  hasControl: boolean;
+  closeInfo: message.Close | null;
+  errorMsg: string | null; // why server rejected the connection
 }
 
 function getSiteTitle(streamerId: string, title: string) {
@@ -82,6 +98,9 @@ class Room extends React.Component<Props, State> {
   navbarRef: React.RefObject<HTMLDivElement>;
   mouseMovetimeout: ReturnType<typeof setTimeout> | null = null;
   ws: WebSocket | null = null;
+  lastSeq: number = 0; // sequence number of the last stream message
+  retries: number = 0;
+  closed: boolean = false; // stream ended or viewer left, no need to reconnect
   msgManager: PubSub | null = null;
 
   constructor(props: Props) {
@@ -97,6 +116,9 @@ class Room extends React.Component<Props, State> {
       connectStatus: RoomStatus.Streaming,
       fullScreen: null,
       orientation: null,
+      hasControl: false,
+      closeInfo: null,
+      errorMsg: null,
     };
 
   }
@@ -164,16 +186,16 @@ class Room extends React.Component<Props, State> {
   }
 
   componentWillUnmount() {
+    this.closed = true;
     this.ws?.close();
   }
 
-
-  componentDidMount() {
+  // set up websocket connection
+  // viewers that reconnect resume from the last stream message they got
+  connect(msgManager: PubSub) {
     const wsUrl = utils.getWsUrl(this.props.match.params.roomID);
-    const msgManager = new PubSub();
-
-    // set up websocket connection
     const ws =  new WebSocket(wsUrl);
+    ws.binaryType = "arraybuffer";
 
     const query = new URLSearchParams(this.props.location.search);
     // Send client info for server to verify
@@ -182,34 +204,54 @@ class Room extends React.Component<Props, State> {
       Data: {
         Role: constants.MSG_ROLE_VIEWER, 
         Key: query.get("key"),
+        Encoding: constants.ENCODING_BINARY,
+        ProtocolVersion: constants.PROTOCOL_VERSION,
+        Capabilities: [constants.CAP_BINARY, constants.CAP_RESUME, constants.CAP_DIRECT],
+        LastSeq: this.lastSeq,
       }
     })
 
     utils.sendWhenConnected(ws, payload);
 
+    ws.onopen = () => {
+      this.retries = 0;
+    }
+
     ws.onclose = (ev: CloseEvent) => {
       let roomInfo = this.state.roomInfo;
-      if (roomInfo && roomInfo.Status !== RoomStatus.NotExisted && roomInfo.Status !== RoomStatus.Unauthorized) {
+      if (this.closed || !roomInfo || roomInfo.Status !== RoomStatus.Streaming) return;
+
+      if (this.retries < MaxReconnectTries) {
+        // connection dropped while streaming, try again with backoff
+        setTimeout(() => this.connect(msgManager), 1000 * 2 ** this.retries);
+        this.retries++;
+      } else {
         roomInfo.Status = RoomStatus.Stopped;
         this.setState({roomInfo: roomInfo});
       }
     }
 
-    // TODO : reconnect on error
-    // https://github.com/joewalnes/reconnecting-websocket
     ws.onerror = (ev: Event) => {
+      // errors of reconnecting are handled on close
+      if (this.state.roomInfo) return;
       let roomInfo = {} as RoomInfo;
       roomInfo.Status = RoomStatus.NotExisted;
       this.setState({roomInfo: roomInfo});
     }
 
     ws.onmessage = (ev: MessageEvent) => {
-      let msg = JSON.parse(ev.data);
+      let msg = typeof ev.data === "string" ? JSON.parse(ev.data) : binary.decode(ev.data);
+      if (msg.Seq) {
+        // skip stream messages we already have, snapshots are always newer than what came before them
+        if (msg.Seq <= this.lastSeq && !isSnapshot(msg)) return;
+        this.lastSeq = Math.max(this.lastSeq, msg.Seq);
+      }
 
       switch (msg.Type) {
 
         case constants.MSG_TWRITEBLOCK:
-          let blockMsg: message.TermWriteBlock = JSON.parse(window.atob(msg.Data));
+          // binary frames have the block decoded already
+          let blockMsg: message.TermWriteBlock = typeof msg.Data === "string" ? JSON.parse(window.atob(msg.Data)) : msg.Data;
           msgManager.pub(msg.Type, blockMsg);
           break;
 
@@ -218,6 +260,14 @@ class Room extends React.Component<Props, State> {
           msgManager.pub(msg.Type, msg.Data);
           break;
 
+        // streamer in direct mode sends messages one by one
+        case constants.MSG_TWRITE:
+        case constants.MSG_TSNAPSHOT:
+        case constants.MSG_TPAUSE:
+
+          msgManager.pub(msg.Type, msg.Data);
+          break;
+
         case constants.MSG_TCHAT:
 
           msgManager.pub(constants.MSG_TCHAT_IN, msg.Data);
@@ -228,6 +278,16 @@ class Room extends React.Component<Props, State> {
           this.setState({roomInfo: msg.Data});
           break;
 
+        case constants.MSG_TCONTROL:
+          let control: message.Control = msg.Data;
+          this.setState({hasControl: control.Granted});
+          break;
+
+        case constants.MSG_TCLOSE:
+          this.closed = true;
+          this.setState({closeInfo: msg.Data});
+          break;
+
         case constants.MSG_TUNAUTHORIZED:
           this.setState({roomInfo: {
               ...this.state.roomInfo, 
@@ -238,6 +298,19 @@ class Room extends React.Component<Props, State> {
           ws.close();
           break;
 
+        case constants.MSG_TPROTOCOL:
+          // nothing to adjust, server rejects us if it can't serve what we need
+          break;
+
+        case constants.MSG_TERROR:
+          this.closed = true;
+          if (this.state.roomInfo?.Status === RoomStatus.Unauthorized) break;
+          this.setState({
+            roomInfo: { ...this.state.roomInfo, Status: RoomStatus.Rejected } as RoomInfo,
+            errorMsg: msg.Data.Message,
+          });
+          break;
+
         default:
 
           console.error("Unhandled message: ", msg.Type)
@@ -245,6 +318,13 @@ class Room extends React.Component<Props, State> {
       }
     }
 
+    this.ws = ws;
+  }
+
+  componentDidMount() {
+    const msgManager = new PubSub();
+    this.connect(msgManager);
+
     // set up msg manager to manage all in and out request of websocket
     msgManager.sub("request", (msgType: string) => {
 
@@ -253,7 +333,7 @@ class Room extends React.Component<Props, State> {
         Data: "",
       });
 
-      utils.sendWhenConnected(ws, payload);
+      utils.sendWhenConnected(this.ws!, payload);
 
     })
 
@@ -265,7 +345,16 @@ class Room extends React.Component<Props, State> {
         Data: chatList,
       });
 
-      utils.sendWhenConnected(ws, payload);
+      utils.sendWhenConnected(this.ws!, payload);
+    })
+
+    msgManager.sub(constants.MSG_TINPUT, (data: string) => {
+      let payload = JSON.stringify({
+        Type: constants.MSG_TINPUT,
+        Data: buffer.ab2base64(new TextEncoder().encode(data)),
+      });
+
+      utils.sendWhenConnected(this.ws!, payload);
     })
 
     msgManager.pub("request", constants.MSG_TREQUEST_ROOM_INFO);
@@ -276,7 +365,6 @@ class Room extends React.Component<Props, State> {
     }, 5000);
 
     this.msgManager = msgManager;
-    this.ws = ws;
 
     this.arrangeTermChat(this.state.fullScreen);
     window.addEventListener('resize', () => {
@@ -328,13 +416,27 @@ class Room extends React.Component<Props, State> {
                   width={terminalSize.width}
                   height={terminalSize.height}
                   delay={this.state.roomInfo.Delay}
+                  control={this.state.hasControl}
                 />}
+
+                {this.state.roomInfo?.Status == RoomStatus.Streaming && (this.state.hasControl || (this.state.roomInfo.Collaborators?.length ?? 0) > 0) &&
+                  <div id="info-control" className="p-1 bg-yellow-600 rounded absolute top-4 left-4 z-10">
+                    <p className="text-md text-white font-semibold">
+                      {this.state.hasControl ? "⌨ You have control, type into the terminal" : `⌨ ${this.state.roomInfo.Collaborators!.join(", ")} has control`}
+                    </p>
+                  </div>
+                }
                 {this.state.roomInfo?.Status != RoomStatus.Streaming &&
                   <div
                     style={terminalSize}
                     className="bg-black flex justify-center items-center">
                     {this.state.roomInfo?.Status == RoomStatus.Stopped && 
-                      <p className="text-2xl font-bold">The stream has stopped</p>
+                      <div className="text-center">
+                        <p className="text-2xl font-bold">The stream has stopped</p>
+                        {this.state.closeInfo &&
+                          <p className="text-lg font-mono">{this.state.closeInfo.Command} exited with code {this.state.closeInfo.ExitCode}</p>
+                        }
+                      </div>
                     }
                     
                     {this.state.roomInfo?.Status == RoomStatus.NotExisted && 
@@ -345,6 +447,10 @@ class Room extends React.Component<Props, State> {
                       <p className="text-2xl font-bold">You're not authorized to view this room</p>
                     }
 
+                    {this.state.roomInfo?.Status == RoomStatus.Rejected && 
+                      <p className="text-2xl font-bold">{this.state.errorMsg}</p>
+                    }
+
                   </div>
                 }
 
@@ -2,19 +2,42 @@ export interface Wrapper {
   Type: string;
   Data: any;
   Delay: number;
+  Seq?: number; // set on stream messages broadcast by server
 }
 
 export interface TermWriteBlock {
-  Data: string;
+  Data: string | Uint8Array; // base64 in JSON, raw bytes in binary frames
   Duration: number;
   StartTime: string;
 }
 
+export interface Snapshot {
+  Rows: number;
+  Cols: number;
+  Data: string; // redraw the whole screen
+}
+
+export interface Control {
+  ID?: string; // client ID of viewer, set when streamer grants or revokes
+  Name: string;
+  Granted: boolean;
+}
+
+export interface Pause {
+  Paused: boolean;
+}
+
+export interface Close {
+  Command: string;
+  ExitCode: number;
+}
+
 export interface ChatMsg {
   Name: string;
   Content: string;
   Color: string;
   Time: string;
+  ID?: string; // client ID of sender, set by server
 }
 
 export enum RoomStatus {
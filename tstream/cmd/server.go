@@ -26,6 +26,9 @@ func main() {
 
 	var db_path = flag.String("db", ".db", "Path to database")
 	var host = flag.String("host", "localhost:3000", "Host address to serve server")
+	var record_dir = flag.String("records", ".records", "Directory to store session recordings. Set to empty to disable recording")
+	var ssh_host = flag.String("ssh", "", "Address to serve SSH gateway for viewers, e.g. :2222. Set to empty to disable")
+	var ssh_key = flag.String("ssh-key", ".ssh_host_key", "Path to host key of SSH gateway. Generated if not existed")
 	var version = flag.Bool("version", false, fmt.Sprintf("TStream server version: %s", cfg.SERVER_VERSION))
 
 	flag.Parse()
@@ -38,12 +41,15 @@ func main() {
 		return
 	}
 
-	s, err := server.New(*host, *db_path)
+	s, err := server.New(*host, *db_path, *record_dir)
 	if err != nil {
 		fmt.Printf("Failed to create server: %s", err)
 		log.Printf("Failed to create server: %s", err)
 		return
 	}
+	if *ssh_host != "" {
+		go s.StartSSH(*ssh_host, *ssh_key)
+	}
 	s.Start()
 	return
 }
@@ -24,11 +24,16 @@ import (
 	"github.com/manifoldco/promptui"
 	"github.com/qnkhuat/tstream/internal/cfg"
 	"github.com/qnkhuat/tstream/internal/logging"
+	"github.com/qnkhuat/tstream/pkg/message"
 	"github.com/qnkhuat/tstream/pkg/streamer"
 	"log"
 	"os"
 	"os/user"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func validateUsername(input string) error {
@@ -56,19 +61,298 @@ func validateRoomKey(input string) error {
 	}
 }
 
+// Ask a yes/no question, anything but an answer starting with y is a no
+func confirm(question string) bool {
+	fmt.Printf("%s (y/n): ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	return len(answer) > 0 && answer[0] == 'y'
+}
+
+// tstream export <room-id> [-format asciicast] [-o file]
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Export a recorded session: tstream export <room-id> [options]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	var format = fs.String("format", "asciicast", "Format of exported file. Supported: asciicast")
+	var output = fs.String("o", "", "Output file. Default is <room-id>.cast")
+	var server = fs.String("server", "https://server.tstream.xyz", "Server endpoint")
+
+	// allow flags to be placed after room id
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	roomIDArg := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	roomID, err := strconv.ParseUint(roomIDArg, 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid room id: %s\n", roomIDArg)
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		*output = fmt.Sprintf("%d.cast", roomID)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Printf("Failed to create file: %s\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	if err := streamer.Export(*server, roomID, *format, f); err != nil {
+		log.Printf("Failed to export: %s", err)
+		fmt.Println(err)
+		f.Close()
+		os.Remove(*output)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported room %d to: %s\n", roomID, *output)
+}
+
+// Delay of stream from flags, then config file, then defaults
+func streamDelay(fs *flag.FlagSet, config streamer.Config, delay, blockDuration time.Duration, lowLatency bool) (time.Duration, time.Duration) {
+	if lowLatency {
+		return cfg.STREAMER_LOW_LATENCY_DELAY * time.Millisecond, cfg.STREAMER_LOW_LATENCY_DELAY * time.Millisecond
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["delay"] && config.Delay > 0 {
+		delay = time.Duration(config.Delay) * time.Millisecond
+	}
+	if !set["block"] && config.BlockDuration > 0 {
+		blockDuration = time.Duration(config.BlockDuration) * time.Millisecond
+	}
+	return delay, blockDuration
+}
+
+// tstream import <file> [options]
+// Stream a recorded asciicast or ttyrec file as a room
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Stream a recorded session: tstream import <file> [options]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	var format = fs.String("format", "", "Format of the file: asciicast or ttyrec. Detected by file extension by default")
+	var username = fs.String("username", "", "Username to stream as. Default is the username in config")
+	var title = fs.String("title", "", "Stream title. Default is the file name")
+	var loop = fs.Bool("loop", false, "Replay the file until stopped")
+	var cols = fs.Uint("cols", 80, "Terminal width for formats that don't store it")
+	var rows = fs.Uint("rows", 24, "Terminal height for formats that don't store it")
+	var private = fs.Bool("private", false, "Start a private session")
+	var client = fs.String("client", "https://tstream.xyz", "TStream client url")
+	var server = fs.String("server", "https://server.tstream.xyz", "Server endpoint")
+
+	// allow flags to be placed after the file
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	if *username == "" {
+		config, err := streamer.ReadCfg(streamer.CONFIG_PATH)
+		if err != nil || config.Username == "" {
+			fmt.Printf("No username found. Please provide one with -username\n")
+			os.Exit(1)
+		}
+		*username = config.Username
+	}
+	if err := validateUsername(*username); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *title == "" {
+		*title = filepath.Base(path)
+	}
+
+	s := streamer.New(*client, *server, *username, *title)
+	if *private {
+		s.SetPrivate(true)
+		s.SetKey(uuid.NewString())
+	}
+
+	statusCode, err := s.RequestAddRoom(false)
+	if err != nil {
+		fmt.Printf("Server is unreachable: %s\n", err)
+		os.Exit(1)
+	}
+	log.Printf("Got status code: %d", statusCode)
+	if statusCode == 400 {
+		if !confirm("Detected a session is streaming with the same username\nReplace it with this recording?") {
+			os.Exit(1)
+		}
+		if statusCode, err := s.RequestAddRoom(true); err != nil || statusCode != 200 {
+			fmt.Printf("Failed to take over the session: %d %v\n", statusCode, err)
+			os.Exit(1)
+		}
+	} else if statusCode == 401 {
+		fmt.Printf("Username: %s is currently used by other streamer. Please use a different username!\n", *username)
+		os.Exit(1)
+	} else if statusCode == 426 {
+		fmt.Printf("Please update Tstream to continue streaming\nFind the latest version at: https://github.com/qnkhuat/tstream/releases\n")
+		os.Exit(1)
+	}
+
+	winsize := message.Winsize{Cols: uint16(*cols), Rows: uint16(*rows)}
+	if err := s.Play(path, *format, winsize, *loop); err != nil { // blocking call
+		log.Printf("Failed to play %s: %s", path, err)
+		fmt.Printf("Failed to play %s: %s\n", path, err)
+		os.Exit(1)
+	}
+}
+
+// tstream upload <file> [options]
+// Upload a session recorded offline
+func runUpload(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Upload a session recorded offline: tstream upload <file> [options]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	var title = fs.String("title", "", "Session title. Default is the file name")
+	var server = fs.String("server", "https://server.tstream.xyz", "Server endpoint")
+
+	// allow flags to be placed after the file
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	config, err := streamer.ReadCfg(streamer.CONFIG_PATH)
+	if err != nil || config.Username == "" {
+		fmt.Printf("No username found. Please start a stream first\n")
+		os.Exit(1)
+	}
+
+	if *title == "" {
+		*title = filepath.Base(path)
+	}
+
+	s := streamer.New("", *server, config.Username, *title)
+	info, _, err := s.Upload(path)
+	if err != nil {
+		log.Printf("Failed to upload %s: %s", path, err)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Uploaded %s as room %d\n", path, info.Id)
+}
+
+// tstream watch <username> [options]
+// Watch a stream from terminal
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Watch a stream: tstream watch <streamer username> [options]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	var key = fs.String("key", "", "Room key if the room is private")
+	var username = fs.String("username", "", "Username to chat as. Default is the username in config")
+	var server = fs.String("server", "https://server.tstream.xyz", "Server endpoint")
+
+	// allow flags to be placed after the room
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	roomName := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	if *username == "" {
+		if config, err := streamer.ReadCfg(streamer.CONFIG_PATH); err == nil && config.Username != "" {
+			*username = config.Username
+		} else if u, err := user.Current(); err == nil {
+			*username = u.Username
+		}
+	}
+
+	v := streamer.NewViewer(*server, roomName, *username, *key)
+	if err := v.Start(); err != nil { // blocking call
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// tstream pause, tstream resume
+// Pause or resume the session this command runs in
+func runPause(pause bool) {
+	if err := streamer.SignalPause(pause); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if pause {
+		fmt.Println("⏸ Paused. Viewers see an away screen, type `tstream resume` to continue streaming")
+	} else {
+		fmt.Println("▶ Streaming again")
+	}
+}
+
 func main() {
 
 	logging.Config("/tmp/tstream.log", "STREAMER: ")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "To Stream: just type in `tstream`.\n\nAdvanced config:\n")
+		fmt.Fprintf(os.Stderr, "To Stream: just type in `tstream`.\nTo stream a single program: `tstream [options] -- <command> [args...]`\n\nAdvanced config:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  watch <username>\n\tWatch a stream from terminal. Run `tstream watch -h` for options\n")
+		fmt.Fprintf(os.Stderr, "  export <room-id>\n\tExport a recorded session. Run `tstream export -h` for options\n")
+		fmt.Fprintf(os.Stderr, "  upload <file>\n\tUpload a session recorded offline. Run `tstream upload -h` for options\n")
+		fmt.Fprintf(os.Stderr, "  import <file>\n\tStream an asciicast or ttyrec file. Run `tstream import -h` for options\n")
+		fmt.Fprintf(os.Stderr, "  pause, resume\n\tHide the terminal from viewers for a while. Run inside a streaming session\n")
 		fmt.Printf("\nFind a bug? Create an issue at: https://github.com/qnkhuat/tstream\n")
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "watch":
+			runWatch(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "upload":
+			runUpload(os.Args[2:])
+			return
+		case "pause":
+			runPause(true)
+			return
+		case "resume":
+			runPause(false)
+			return
+		}
+	}
+
 	var private = flag.Bool("private", false, "Start a private session")
 	var chat = flag.Bool("chat", false, "Open chat client: %s")
 	var client = flag.String("client", "https://tstream.xyz", "TStream client url")
 	var server = flag.String("server", "https://server.tstream.xyz", "Server endpoint")
+	var offline = flag.Bool("offline", false, "Record the session locally and upload it when finished")
+	var record = flag.String("record", "", "Keep a local copy of the session in this file")
+	var delay = flag.Duration("delay", cfg.STREAMER_DEFAULT_DELAY*time.Millisecond, "How far behind viewers watch, a longer delay gives a smoother stream")
+	var blockDuration = flag.Duration("block", cfg.STREAMER_DEFAULT_BLOCK*time.Millisecond, "Send output to server in blocks of this duration, at most the delay")
+	var lowLatency = flag.Bool("low-latency", false, fmt.Sprintf("Stream with %dms delay, for pairing", cfg.STREAMER_LOW_LATENCY_DELAY))
+	var direct = flag.Bool("direct", false, "Send output to viewers as it's written instead of with delay, for pairing")
+	var noRedact = flag.Bool("no-redact", false, "Don't mask secrets like tokens and passwords in the stream")
+	var tmux = flag.String("tmux", "", "Stream a running tmux session instead of a new shell, e.g. work or work:1.2")
 	var version = flag.Bool("version", false, fmt.Sprintf("TStream version: %s", cfg.STREAMER_VERSION))
 
 	flag.Parse()
@@ -130,6 +414,41 @@ func main() {
 		}
 
 		s := streamer.New(*client, *server, username, title)
+		s.SetOffline(*offline)
+		// stream a program given after `--` instead of a shell
+		s.SetCommand(flag.Args())
+
+		if *tmux != "" {
+			if len(flag.Args()) > 0 {
+				fmt.Printf("Can't stream a tmux session and a command at the same time\n")
+				os.Exit(1)
+			}
+			if err := s.AttachTmux(*tmux); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		if *direct {
+			s.SetMode(message.MDirect)
+		} else if err := s.SetDelay(streamDelay(flag.CommandLine, config, *delay, *blockDuration, *lowLatency)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		filters, err := streamer.ConfigFilters(config, !*noRedact)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, filter := range filters {
+			s.AddFilter(filter)
+		}
+
+		if *private && *offline {
+			fmt.Printf("Private sessions can't be uploaded\n")
+			os.Exit(1)
+		}
 
 		if *private {
 			var roomKey string
@@ -142,12 +461,27 @@ func main() {
 		}
 
 		// Request server add room and check availability
-		statusCode := s.RequestAddRoom()
-		log.Printf("Got status code: %d", statusCode)
-		if statusCode == 400 {
-			fmt.Printf("Detected a session is streaming with the same username\nProceed to stream from this terminal? (y/n): ")
-			confirm, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-			if confirm[0] != 'y' {
+		statusCode := 200
+		var addErr error
+		if !s.Offline() {
+			statusCode, addErr = s.RequestAddRoom(false)
+			log.Printf("Got status code: %d", statusCode)
+		}
+		if addErr != nil && *private {
+			// private sessions are never uploaded
+			fmt.Printf("Server is unreachable: %s\n", addErr)
+			os.Exit(1)
+		} else if addErr != nil {
+			if !confirm("Server is unreachable\nRecord offline and upload the session when server is back?") {
+				os.Exit(1)
+			}
+			s.SetOffline(true)
+		} else if statusCode == 400 {
+			if !confirm("Detected a session is streaming with the same username\nProceed to stream from this terminal?") {
+				os.Exit(1)
+			}
+			if statusCode, err := s.RequestAddRoom(true); err != nil || statusCode != 200 {
+				fmt.Printf("Failed to take over the session: %d %v\n", statusCode, err)
 				os.Exit(1)
 			}
 		} else if statusCode == 401 {
@@ -156,17 +490,42 @@ func main() {
 		} else if statusCode == 426 {
 			fmt.Printf("Please update Tstream to continue streaming\nFind the latest version at: https://github.com/qnkhuat/tstream/releases\n")
 			os.Exit(1)
+		} else if statusCode == 422 {
+			fmt.Printf("Server doesn't support a delay of %s\n", s.Delay())
+			os.Exit(1)
 		}
 
 		// Update config before start
 		config.Username = username
 		streamer.UpdateCfg(streamer.CONFIG_PATH, "Username", username)
 
+		if s.Offline() && *record == "" {
+			*record = streamer.DefaultRecordPath()
+		}
+		if *record != "" {
+			if err := s.SetRecordFile(*record); err != nil {
+				fmt.Printf("Failed to create record file: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
 		err = s.Start() // blocking call
 		if err != nil {
 			log.Printf("Failed to start tstream : %s", err)
 			fmt.Printf("Failed to start tstream : %s\n", err)
+			return
+		}
+
+		if s.Offline() {
+			info, err := s.UploadWhenOnline(s.RecordFile()) // blocking call
+			if err != nil {
+				log.Printf("Failed to upload %s: %s", s.RecordFile(), err)
+				fmt.Printf("%s\nThe session is kept at: %s\n", err, s.RecordFile())
+				os.Exit(1)
+			}
+			fmt.Printf("Uploaded the session as room %d\n", info.Id)
 		}
+		os.Exit(s.ExitCode())
 		return
 	} else {
 		// Open chat window
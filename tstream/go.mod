@@ -3,21 +3,20 @@ module github.com/qnkhuat/tstream
 go 1.16
 
 require (
-	github.com/boltdb/bolt v1.3.1
 	github.com/creack/pty v1.1.13
-	github.com/gdamore/tcell/v2 v2.3.3
+	github.com/gdamore/tcell/v2 v2.6.0
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/schema v1.2.0
 	github.com/gorilla/websocket v1.4.2
+	github.com/hinshun/vt10x v0.0.0-20220119200601-820417d04eec
 	github.com/manifoldco/promptui v0.8.0
 	github.com/pion/rtcp v1.2.6
 	github.com/pion/webrtc/v3 v3.0.31
 	github.com/qnkhuat/mediadevices v0.2.3
 	github.com/rivo/tview v0.0.0-20210624165335-29d673af0ce2
 	github.com/rs/cors v1.8.0
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
-	golang.org/x/net v0.0.0-20210716203947-853a461950ff // indirect
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
-	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.15.0
+	golang.org/x/net v0.18.0 // indirect
 )
@@ -4,18 +4,37 @@ const (
 	SERVER_VERSION                   = "1.3.3" // Version of tstream server
 	STREAMER_VERSION                 = "1.3.3" // Version of tstream client
 	SERVER_STREAMER_REQUIRED_VERSION = "1.3.2" // Streamer have to run this version or later to connect to server
+	PROTOCOL_VERSION                 = 2       // Version of websocket protocol
+	SERVER_PROTOCOL_MIN_VERSION      = 1       // Clients have to speak this protocol version or later
 
 	// Room
-	ROOM_BUFFER_SIZE    = 3    // number of recent broadcast message to buffer
-	ROOM_CACHE_MSG_SIZE = 25   // number of recent chat messages to buffer
-	ROOM_DEFAULT_DELAY  = 3000 // act as both block size and delay time of streaming
+	ROOM_CACHE_MSG_SIZE    = 25    // number of recent chat messages to buffer
+	ROOM_DEFAULT_DELAY     = 1500  // Delay of rooms whose streamer doesn't choose one. Unit in milliseconds
+	ROOM_MIN_DELAY         = 50    // Also the shortest block streamer can send. Unit in milliseconds
+	ROOM_MAX_DELAY         = 60000 // Unit in milliseconds
+	ROOM_KEYFRAME_INTERVAL = 30    // Interval to store a snapshot of the terminal in recording. Unit in seconds
+	ROOM_RESUME_BUFFER     = 128   // number of recent stream messages kept for viewers to resume from
+	ROOM_MAX_BLOCK_SIZE    = 16    // Max size of a block once decompressed. Unit in megabytes
+
+	// What to do with viewers too slow to keep up unless they choose: DropOldest, Snapshot or Disconnect
+	ROOM_VIEWER_POLICY = "Snapshot"
 
 	// Streamer
 	STREAMER_READ_BUFFER_SIZE    = 1024 // streamer websocket read buffer size
 	STREAMER_WRITE_BBUFFER_SIZE  = 1024 // streamer websocket write buffer size
-	STREAMER_REFRESH_INTERVAL    = 30   // Interval to refresh streamer pty. Unit in seconds
+	STREAMER_SNAPSHOT_INTERVAL   = 30   // Interval to send a snapshot of streamer's screen. Unit in seconds
 	STREAMER_ENVKEY_SESSIONID    = "TSTREAM_SESSIONID"
-	STREAMER_RETRY_CONNECT_AFTER = 10 // retry connect with server if websocket is broke
+	STREAMER_ENVKEY_PID          = "TSTREAM_PID"
+	STREAMER_RETRY_CONNECT_AFTER = 10   // retry connect with server if websocket is broke
+	STREAMER_DEFAULT_DELAY       = 1500 // Unit in milliseconds
+	STREAMER_DEFAULT_BLOCK       = 1000 // Duration of each block sent to server, has to be smaller than delay. Unit in milliseconds
+	STREAMER_LOW_LATENCY_DELAY   = 100  // Delay and block duration of low latency mode. Unit in milliseconds
+	STREAMER_DIRECT_COALESCE     = 5    // Writes within this duration are sent together in direct mode. Unit in milliseconds
+	STREAMER_RECONNECT_MIN       = 1    // First retry after connection is lost, doubled after each failed retry. Unit in seconds
+	STREAMER_RECONNECT_MAX       = 60   // Longest wait between retries. Unit in seconds
+	STREAMER_QUEUE_SIZE          = 8    // Max size of messages kept while offline, oldest are dropped. Unit in megabytes
+	STREAMER_PING_TIMEOUT        = 30   // Connection is lost if server doesn't ping for this long. Unit in seconds
+	STREAMER_WRITE_TIMEOUT       = 10   // Unit in seconds
 
 	// Server. All units are in seconds
 	SERVER_READ_BUFFER_SIZE        = 1024    // server websocket read buffer size
@@ -25,4 +44,5 @@ const (
 	SERVER_PING_INTERVAL           = 10      // Interval to ping streamer to check status
 	SERVER_DISCONNECTED_THRESHHOLD = 60      // Threshold of inactive time to classify streamer as disconnected
 	SERVER_SYNCDB_INTERVAL         = 60      // Sync server state with DB interval
+	SERVER_MAX_UPLOAD_SIZE         = 256     // Max size of an uploaded recording. Unit in megabytes
 )
@@ -0,0 +1,118 @@
+/*
+asciicast v2 file format used by asciinema
+https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+
+A file is a JSON header line followed by one JSON array per event:
+[time in seconds, event type, data]
+*/
+package asciicast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const VERSION = 2
+
+type EventType string
+
+const (
+	EOutput EventType = "o"
+	EInput  EventType = "i"
+	EResize EventType = "r" // data is "{cols}x{rows}"
+)
+
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type Event struct {
+	Time float64 // seconds since the start of the recording
+	Type EventType
+	Data string
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("Invalid event: %s", data)
+	}
+	if err := json.Unmarshal(fields[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields[1], &e.Type); err != nil {
+		return err
+	}
+	return json.Unmarshal(fields[2], &e.Data)
+}
+
+func ResizeData(cols, rows uint16) string {
+	return fmt.Sprintf("%dx%d", cols, rows)
+}
+
+type Writer struct {
+	enc *json.Encoder
+}
+
+// Create a writer and write the header
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	header.Version = VERSION
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	return &Writer{enc: enc}, nil
+}
+
+func (w *Writer) WriteEvent(e Event) error {
+	return w.enc.Encode(e)
+}
+
+type Reader struct {
+	dec    *json.Decoder
+	header Header
+}
+
+// Create a reader and read the header
+func NewReader(r io.Reader) (*Reader, error) {
+	dec := json.NewDecoder(r)
+	header := Header{}
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != VERSION {
+		return nil, fmt.Errorf("Unsupported asciicast version: %d", header.Version)
+	}
+	return &Reader{dec: dec, header: header}, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Return io.EOF when there is no event left
+func (r *Reader) Next() (Event, error) {
+	e := Event{}
+	err := r.dec.Decode(&e)
+	return e, err
+}
+
+// Parse data of a resize event
+func ParseResizeData(data string) (cols, rows uint16, err error) {
+	_, err = fmt.Sscanf(data, "%dx%d", &cols, &rows)
+	return cols, rows, err
+}
@@ -0,0 +1,351 @@
+/*
+Headless terminal emulator
+Keep track of what a terminal screen looks like by parsing the stream it renders
+so the screen can be re-drawn from scratch at any time
+*/
+package emulator
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/hinshun/vt10x"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+const (
+	DEFAULT_COLS = 80
+	DEFAULT_ROWS = 24
+	// Larger sizes are clamped, the screen buffer is allocated upfront so winsize from streamer can't be trusted
+	MAX_COLS = 1000
+	MAX_ROWS = 500
+
+	enterAltScreen = "\x1b[?1049h"
+	exitAltScreen  = "\x1b[?1049l"
+)
+
+// Glyph attributes as defined in vt10x
+const (
+	attrReverse = 1 << iota
+	attrUnderline
+	attrBold
+	attrGfx
+	attrItalic
+	attrBlink
+)
+
+type Emulator struct {
+	lock sync.Mutex
+	term vt10x.Terminal
+
+	// bytes of an utf8 rune that is split between two writes
+	pending []byte
+
+	// streamer paused the stream
+	paused bool
+}
+
+func New(cols, rows int) *Emulator {
+	if cols <= 0 || rows <= 0 {
+		cols, rows = DEFAULT_COLS, DEFAULT_ROWS
+	}
+	cols, rows = clampSize(cols, rows)
+	return &Emulator{
+		term: vt10x.New(vt10x.WithSize(cols, rows)),
+	}
+}
+
+func (e *Emulator) Write(data []byte) (int, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	buf := append(e.pending, data...)
+	cut := len(buf) - IncompleteRuneLen(buf)
+	e.pending = append([]byte{}, buf[cut:]...)
+
+	if _, err := e.term.Write(buf[:cut]); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (e *Emulator) Resize(cols, rows int) {
+	if cols <= 0 || rows <= 0 {
+		return
+	}
+	cols, rows = clampSize(cols, rows)
+	e.lock.Lock()
+	e.term.Resize(cols, rows)
+	e.lock.Unlock()
+}
+
+func clampSize(cols, rows int) (int, int) {
+	if cols > MAX_COLS {
+		cols = MAX_COLS
+	}
+	if rows > MAX_ROWS {
+		rows = MAX_ROWS
+	}
+	return cols, rows
+}
+
+func (e *Emulator) Size() (cols, rows int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.term.Size()
+}
+
+// Update the screen with a message streamed by streamer
+func (e *Emulator) WriteMsg(msg message.Wrapper) error {
+	switch msg.Type {
+
+	case message.TWrite:
+		var data []byte
+		if err := message.ToStruct(msg.Data, &data); err != nil {
+			return err
+		}
+		_, err := e.Write(data)
+		return err
+
+	case message.TWinsize:
+		winsize := message.Winsize{}
+		if err := message.ToStruct(msg.Data, &winsize); err != nil {
+			return err
+		}
+		e.Resize(int(winsize.Cols), int(winsize.Rows))
+
+	case message.TWriteBlock:
+		block, err := message.ToTermWriteBlock(msg.Data)
+		if err != nil {
+			return err
+		}
+		msgs, err := message.DecodeBlock(block)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := e.WriteMsg(msg); err != nil {
+				return err
+			}
+		}
+
+	case message.TSnapshot:
+		snapshot := message.Snapshot{}
+		if err := message.ToStruct(msg.Data, &snapshot); err != nil {
+			return err
+		}
+		e.Restore(snapshot)
+
+	case message.TPause:
+		pause := message.Pause{}
+		if err := message.ToStruct(msg.Data, &pause); err != nil {
+			return err
+		}
+		e.lock.Lock()
+		e.paused = pause.Paused
+		e.lock.Unlock()
+	}
+
+	return nil
+}
+
+// Reset the screen to the state of a snapshot
+func (e *Emulator) Restore(snapshot message.Snapshot) {
+	cols, rows := clampSize(int(snapshot.Cols), int(snapshot.Rows))
+	e.lock.Lock()
+	e.term = vt10x.New(vt10x.WithSize(cols, rows))
+	e.pending = nil
+	e.paused = snapshot.Paused
+	e.lock.Unlock()
+
+	// vt10x toggles the alternate screen even if it's not in one
+	e.Write(bytes.TrimPrefix(snapshot.Data, []byte(exitAltScreen)))
+}
+
+// Capture the current screen, cursor and attributes
+func (e *Emulator) Snapshot() message.Snapshot {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.term.Lock()
+	defer e.term.Unlock()
+
+	cols, rows := e.term.Size()
+	var b bytes.Buffer
+
+	// Switch to the same screen as streamer then clear it
+	if e.term.Mode()&vt10x.ModeAltScreen != 0 {
+		b.WriteString(enterAltScreen)
+	} else {
+		b.WriteString(exitAltScreen)
+	}
+	b.WriteString("\x1b[0m\x1b[H\x1b[2J")
+
+	last := vt10x.Glyph{FG: vt10x.DefaultFG, BG: vt10x.DefaultBG}
+	for y := 0; y < rows; y++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", y+1)
+		for x := 0; x < cols; x++ {
+			cell := e.term.Cell(x, y)
+			if cell.Mode != last.Mode || cell.FG != last.FG || cell.BG != last.BG {
+				b.WriteString(sgr(cell))
+				last = cell
+			}
+			if cell.Char == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteRune(cell.Char)
+			}
+		}
+	}
+	b.WriteString("\x1b[0m")
+
+	cursor := e.term.Cursor()
+	fmt.Fprintf(&b, "\x1b[%d;%dH", cursor.Y+1, cursor.X+1)
+	if e.term.CursorVisible() {
+		b.WriteString("\x1b[?25h")
+	} else {
+		b.WriteString("\x1b[?25l")
+	}
+
+	return message.Snapshot{
+		Rows:   uint16(rows),
+		Cols:   uint16(cols),
+		Data:   b.Bytes(),
+		Paused: e.paused,
+	}
+}
+
+// Whether streamer is away and the screen should be hidden
+func (e *Emulator) Paused() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.paused
+}
+
+// A character on screen
+type Cell struct {
+	Char rune
+	FG   int // color in the 256 colors palette, -1 is terminal's default color
+	BG   int
+
+	Bold      bool
+	Italic    bool
+	Underline bool
+	Blink     bool
+	Reverse   bool
+}
+
+// Cells of the screen, row by row
+func (e *Emulator) Cells() [][]Cell {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.term.Lock()
+	defer e.term.Unlock()
+
+	cols, rows := e.term.Size()
+	cells := make([][]Cell, rows)
+	for y := 0; y < rows; y++ {
+		cells[y] = make([]Cell, cols)
+		for x := 0; x < cols; x++ {
+			glyph := e.term.Cell(x, y)
+			fg, bg := glyph.FG, glyph.BG
+			// vt10x swaps colors of reversed glyph when storing it
+			if glyph.Mode&attrReverse != 0 {
+				fg, bg = bg, fg
+			}
+			cells[y][x] = Cell{
+				Char:      glyph.Char,
+				FG:        paletteColor(fg),
+				BG:        paletteColor(bg),
+				Bold:      glyph.Mode&attrBold != 0,
+				Italic:    glyph.Mode&attrItalic != 0,
+				Underline: glyph.Mode&attrUnderline != 0,
+				Blink:     glyph.Mode&attrBlink != 0,
+				Reverse:   glyph.Mode&attrReverse != 0,
+			}
+		}
+	}
+	return cells
+}
+
+// Position of the cursor
+func (e *Emulator) Cursor() (x, y int, visible bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.term.Lock()
+	defer e.term.Unlock()
+
+	cursor := e.term.Cursor()
+	return cursor.X, cursor.Y, e.term.CursorVisible()
+}
+
+func paletteColor(c vt10x.Color) int {
+	if c < 256 {
+		return int(c)
+	}
+	return -1
+}
+
+// Select graphic rendition sequence to draw a glyph
+func sgr(cell vt10x.Glyph) string {
+	fg, bg := cell.FG, cell.BG
+	params := "0"
+
+	// vt10x swaps colors of reversed glyph when storing it
+	if cell.Mode&attrReverse != 0 {
+		fg, bg = bg, fg
+		params += ";7"
+	}
+	if cell.Mode&attrBold != 0 {
+		params += ";1"
+	}
+	if cell.Mode&attrItalic != 0 {
+		params += ";3"
+	}
+	if cell.Mode&attrUnderline != 0 {
+		params += ";4"
+	}
+	if cell.Mode&attrBlink != 0 {
+		params += ";5"
+	}
+
+	switch {
+	case fg == vt10x.DefaultFG, fg == vt10x.DefaultBG:
+	case fg < 8:
+		params += fmt.Sprintf(";%d", 30+fg)
+	case fg < 16:
+		params += fmt.Sprintf(";%d", 90+fg-8)
+	case fg < 256:
+		params += fmt.Sprintf(";38;5;%d", fg)
+	}
+
+	switch {
+	case bg == vt10x.DefaultFG, bg == vt10x.DefaultBG:
+	case bg < 8:
+		params += fmt.Sprintf(";%d", 40+bg)
+	case bg < 16:
+		params += fmt.Sprintf(";%d", 100+bg-8)
+	case bg < 256:
+		params += fmt.Sprintf(";48;5;%d", bg)
+	}
+
+	return "\x1b[" + params + "m"
+}
+
+// Number of bytes at the end of buf that belong to an incomplete utf8 rune
+func IncompleteRuneLen(buf []byte) int {
+	for i := 1; i <= utf8.UTFMax && i <= len(buf); i++ {
+		start := len(buf) - i
+		if utf8.RuneStart(buf[start]) {
+			if utf8.FullRune(buf[start:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package emulator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Viewers render a snapshot on whatever their screen shows and get the screen of streamer
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{"text", "$ ls\r\nfoo  bar\r\n$ "},
+		{"attributes", "\x1b[1;31mbold red\x1b[0m \x1b[4;44munderline on blue\x1b[0m \x1b[7mreverse\x1b[0m \x1b[38;5;208m256\x1b[0m"},
+		{"wide characters", "héllo 世界\r\n"},
+		{"cursor", "top\x1b[10;20Hmiddle\x1b[5;3H\x1b[?25l"},
+		{"alternate screen", "shell\x1b[?1049h\x1b[Hvim\x1b[24;1H-- INSERT --"},
+	}
+	for _, tt := range tests {
+		streamer := New(80, 24)
+		streamer.Write([]byte(tt.output))
+		snapshot := streamer.Snapshot()
+
+		viewer := New(80, 24)
+		viewer.Write([]byte("\x1b[32mwhat viewer had before\x1b[3;3H"))
+		viewer.Write(snapshot.Data)
+
+		if !reflect.DeepEqual(viewer.Cells(), streamer.Cells()) {
+			t.Errorf("%s: viewer screen differs from streamer", tt.name)
+		}
+		vx, vy, vvisible := viewer.Cursor()
+		sx, sy, svisible := streamer.Cursor()
+		if vx != sx || vy != sy || vvisible != svisible {
+			t.Errorf("%s: got cursor at %d,%d visible %t, want %d,%d visible %t", tt.name, vx, vy, vvisible, sx, sy, svisible)
+		}
+
+		restored := New(40, 10)
+		restored.Restore(snapshot)
+		if cols, rows := restored.Size(); cols != 80 || rows != 24 || !reflect.DeepEqual(restored.Cells(), streamer.Cells()) {
+			t.Errorf("%s: restored screen of %dx%d differs from streamer", tt.name, cols, rows)
+		}
+	}
+}
+
+// Viewers joining while streamer is away get the away screen from the snapshot
+func TestPaused(t *testing.T) {
+	room := New(80, 24)
+	room.WriteMsg(message.Wrapper{Type: message.TPause, Data: message.Pause{Paused: true}})
+	snapshot := room.Snapshot()
+	if !room.Paused() || !snapshot.Paused {
+		t.Errorf("Got paused %t with snapshot paused %t, want both paused", room.Paused(), snapshot.Paused)
+	}
+
+	viewer := New(80, 24)
+	viewer.Restore(snapshot)
+	if !viewer.Paused() {
+		t.Error("Restored screen isn't paused")
+	}
+
+	room.WriteMsg(message.Wrapper{Type: message.TPause, Data: message.Pause{Paused: false}})
+	if room.Paused() || room.Snapshot().Paused {
+		t.Error("Still paused after resume")
+	}
+}
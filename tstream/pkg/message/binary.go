@@ -0,0 +1,112 @@
+/*
+Binary encoding of messages for viewers.
+JSON encodes the gzipped data of a block in base64 twice, binary frames carry it as is.
+
+Frame layout, integers are big endian:
+- 1 byte   : BINARY_VERSION
+- 1 byte   : length of type
+- n bytes  : type
+- 8 bytes  : Seq
+- 8 bytes  : Delay
+- the rest : payload
+
+Payload of TWriteBlock is 8 bytes of StartTime in unix milliseconds, 8 bytes of Duration then the gzipped data.
+Payload of other types is the JSON encoded Data.
+*/
+package message
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const BINARY_VERSION byte = 1
+
+// How messages are encoded on websocket
+type Encoding string
+
+const (
+	EJSON   Encoding = "JSON" // default
+	EBinary Encoding = "Binary"
+)
+
+func EncodeBinary(msg Wrapper) ([]byte, error) {
+	if len(msg.Type) > 255 {
+		return nil, fmt.Errorf("Message type is too long: %s", msg.Type)
+	}
+
+	var payload []byte
+	if msg.Type == TWriteBlock {
+		block, err := ToTermWriteBlock(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		payload = make([]byte, 16+len(block.Data))
+		binary.BigEndian.PutUint64(payload[0:], uint64(block.StartTime.UnixNano()/int64(time.Millisecond)))
+		binary.BigEndian.PutUint64(payload[8:], uint64(block.Duration))
+		copy(payload[16:], block.Data)
+	} else {
+		var err error
+		payload, err = json.Marshal(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	frame := make([]byte, 0, 2+len(msg.Type)+16+len(payload))
+	frame = append(frame, BINARY_VERSION, byte(len(msg.Type)))
+	frame = append(frame, msg.Type...)
+	frame = appendUint64(frame, msg.Seq)
+	frame = appendUint64(frame, uint64(msg.Delay))
+	return append(frame, payload...), nil
+}
+
+// Data of TWriteBlock is decoded to a TermWriteBlock, others are left as JSON
+func DecodeBinary(frame []byte) (Wrapper, error) {
+	msg := Wrapper{}
+	if len(frame) < 2 {
+		return msg, fmt.Errorf("Frame is too short")
+	}
+	if frame[0] != BINARY_VERSION {
+		return msg, fmt.Errorf("Unsupported binary version: %d", frame[0])
+	}
+
+	n := int(frame[1])
+	if len(frame) < 2+n+16 {
+		return msg, fmt.Errorf("Frame is too short")
+	}
+	msg.Type = MType(frame[2 : 2+n])
+	msg.Seq = binary.BigEndian.Uint64(frame[2+n:])
+	msg.Delay = int64(binary.BigEndian.Uint64(frame[2+n+8:]))
+	payload := frame[2+n+16:]
+
+	if msg.Type == TWriteBlock {
+		if len(payload) < 16 {
+			return msg, fmt.Errorf("Block is too short")
+		}
+		msg.Data = TermWriteBlock{
+			StartTime: time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:]))*int64(time.Millisecond)),
+			Duration:  int64(binary.BigEndian.Uint64(payload[8:])),
+			Data:      payload[16:],
+		}
+	} else {
+		msg.Data = json.RawMessage(payload)
+	}
+	return msg, nil
+}
+
+// Decode a websocket message of either encoding
+func Decode(data []byte, isBinary bool) (Wrapper, error) {
+	if isBinary {
+		return DecodeBinary(data)
+	}
+	return Unwrap(data)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,85 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBinaryBlock(t *testing.T) {
+	data, _ := json.Marshal(Wrapper{Type: TWrite, Data: []byte("hello")})
+	start := time.Unix(1600000000, 123000000)
+	msg, err := EncodeBlock([][]byte{data}, start, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Seq, msg.Delay = 42, -3001
+
+	frame, err := EncodeBinary(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeBinary(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != TWriteBlock || got.Seq != 42 || got.Delay != -3001 {
+		t.Errorf("Got %s with seq %d and delay %d", got.Type, got.Seq, got.Delay)
+	}
+
+	block, ok := got.Data.(TermWriteBlock)
+	want, _ := ToTermWriteBlock(msg.Data)
+	if !ok || !block.StartTime.Equal(start) || block.Duration != 3000 || !bytes.Equal(block.Data, want.Data) {
+		t.Errorf("Got block %+v, want %+v", got.Data, want)
+	}
+	msgs, err := DecodeBlock(block)
+	if err != nil || len(msgs) != 1 || msgs[0].Type != TWrite {
+		t.Errorf("Got %v from block: %v", msgs, err)
+	}
+}
+
+func TestBinaryJSON(t *testing.T) {
+	frame, err := EncodeBinary(Wrapper{Type: TChat, Data: []Chat{{Name: "alice", Content: "hi"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeBinary(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chats []Chat
+	if err := ToStruct(got.Data, &chats); err != nil || got.Type != TChat || got.Seq != 0 || len(chats) != 1 || chats[0].Content != "hi" {
+		t.Errorf("Got %s with %v: %v", got.Type, chats, err)
+	}
+}
+
+func TestBinaryBroken(t *testing.T) {
+	block, _ := EncodeBlock([][]byte{}, time.Now(), 0)
+	frame, err := EncodeBinary(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := 2 + len(TWriteBlock) + 16
+
+	for name, data := range map[string][]byte{
+		"empty":             {},
+		"no type":           {BINARY_VERSION},
+		"unknown version":   append([]byte{BINARY_VERSION + 1}, frame[1:]...),
+		"truncated type":    frame[:4],
+		"truncated header":  frame[:header-1],
+		"truncated block":   frame[:header+15],
+		"type out of range": {BINARY_VERSION, 255, 'a'},
+	} {
+		if _, err := DecodeBinary(data); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
+
+func TestBinaryLongType(t *testing.T) {
+	if _, err := EncodeBinary(Wrapper{Type: MType(bytes.Repeat([]byte("a"), 256))}); err == nil {
+		t.Errorf("Got no error for type longer than 255 bytes")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Encode and decode TermWriteBlock
+A block is a gzipped JSON array of encoded messages
+*/
+package message
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/qnkhuat/tstream/internal/cfg"
+)
+
+// Pack a queue of JSON encoded messages into a TWriteBlock message
+func EncodeBlock(queue [][]byte, startTime time.Time, duration time.Duration) (Wrapper, error) {
+	var msg Wrapper
+
+	// Serialize message queue
+	dataByte, err := json.Marshal(queue)
+	if err != nil {
+		return msg, err
+	}
+
+	// compress with gzip
+	// with gzip data often compressed to 1/10 -> 1/8 its original
+	// Note: 3 seconds of parrot generate 70Kb of raw bytes. With gzip the data is just 6k
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(dataByte); err != nil {
+		gz.Close()
+		return msg, err
+	}
+	gz.Close()
+
+	blockMsg := TermWriteBlock{
+		StartTime: startTime,
+		Duration:  duration.Milliseconds(),
+		Data:      b.Bytes(),
+	}
+
+	blockByte, err := json.Marshal(blockMsg)
+	if err != nil {
+		return msg, err
+	}
+
+	msg = Wrapper{
+		Type: TWriteBlock,
+		Data: blockByte,
+	}
+	return msg, nil
+}
+
+// Decompress and decode all messages inside a block
+func DecodeBlock(block TermWriteBlock) ([]Wrapper, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(block.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	// a small block could decompress to anything, read one byte past the limit to tell if it's over
+	limit := int64(cfg.ROOM_MAX_BLOCK_SIZE << 20)
+	dataByte, err := ioutil.ReadAll(io.LimitReader(gz, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(dataByte)) > limit {
+		return nil, fmt.Errorf("Block is larger than %dMB", cfg.ROOM_MAX_BLOCK_SIZE)
+	}
+
+	var queue [][]byte
+	if err := json.Unmarshal(dataByte, &queue); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]Wrapper, 0, len(queue))
+	for _, data := range queue {
+		msg, err := Unwrap(data)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Block that make viewers with delay (in milliseconds) render the snapshot as soon as they receive it
+func SnapshotBlock(snapshot Snapshot, delay int64) (Wrapper, error) {
+	var queue [][]byte
+	msgs := []Wrapper{
+		{Type: TWinsize, Data: Winsize{Rows: snapshot.Rows, Cols: snapshot.Cols}},
+		{Type: TWrite, Data: snapshot.Data},
+	}
+	if snapshot.Paused {
+		msgs = append(msgs, Wrapper{Type: TPause, Data: Pause{Paused: true}})
+	}
+	for _, msg := range msgs {
+		// negative delay means the message is from the past and should be rendered right away
+		msg.Delay = -delay - 1
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return Wrapper{}, err
+		}
+		queue = append(queue, data)
+	}
+	return EncodeBlock(queue, time.Now(), 0)
+}
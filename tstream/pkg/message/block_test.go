@@ -0,0 +1,47 @@
+package message
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/qnkhuat/tstream/internal/cfg"
+)
+
+func gzipBlock(t *testing.T, data []byte) TermWriteBlock {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return TermWriteBlock{StartTime: time.Now(), Data: b.Bytes()}
+}
+
+func TestDecodeBlockLimit(t *testing.T) {
+	msg, _ := json.Marshal(Wrapper{Type: TWrite, Data: []byte("hi")})
+	queue, _ := json.Marshal([][]byte{msg})
+	limit := cfg.ROOM_MAX_BLOCK_SIZE << 20
+
+	tests := []struct {
+		name string
+		size int
+		ok   bool
+	}{
+		{"small", len(queue), true},
+		{"at limit", limit, true},
+		{"over limit", limit + 1, false},
+	}
+	for _, tt := range tests {
+		// pad the queue with spaces, still a valid JSON array
+		data := append(bytes.Repeat([]byte(" "), tt.size-len(queue)), queue...)
+		msgs, err := DecodeBlock(gzipBlock(t, data))
+		if tt.ok && (err != nil || len(msgs) != 1) {
+			t.Errorf("%s: got %d messages: %v, want 1", tt.name, len(msgs), err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: got no error, want the block rejected", tt.name)
+		}
+	}
+}
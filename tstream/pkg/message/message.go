@@ -45,6 +45,28 @@ const (
 
 	TAuthorized   MType = "Authorized"
 	TUnauthorized MType = "Unauthorized"
+
+	// Full state of the terminal screen
+	// Streamer sends one periodically inside blocks so viewers can fix their screen
+	TSnapshot MType = "Snapshot"
+
+	// Viewer of a replay request to jump to a point in time
+	TSeek MType = "Seek"
+
+	// Keystrokes of a collaborator, forwarded to the shell of streamer
+	TInput MType = "Input"
+
+	// Streamer stops or continues streaming its terminal
+	// Sent inside blocks so viewers hide the screen in sync with the stream
+	TPause MType = "Pause"
+
+	// Streamer grants or revokes control of its shell
+	// Server notifies viewers whose control changed with the same message
+	TControl MType = "Control"
+
+	// Server replies ClientInfo with the negotiated protocol
+	// Only sent to clients that sent a protocol version
+	TProtocol MType = "Protocol"
 )
 
 type Wrapper struct {
@@ -54,6 +76,9 @@ type Wrapper struct {
 	// time delay of message to take affect
 	// this time is relative with the start time of the parent data block it is sent with
 	Delay int64 // milliseconds
+
+	// sequence number of messages server broadcasts from streamer
+	Seq uint64 `json:",omitempty"`
 }
 
 type Winsize struct {
@@ -71,12 +96,28 @@ type TermWriteBlock struct {
 	Data []byte
 }
 
+type Snapshot struct {
+	Rows uint16
+	Cols uint16
+
+	// ANSI sequence to draw the screen on a blank terminal
+	Data []byte
+
+	// streamer is away, the screen is hidden from viewers
+	Paused bool `json:",omitempty"`
+}
+
+type Seek struct {
+	Time int64 // milliseconds since the start of recording
+}
+
 type Chat struct {
 	Name    string
 	Content string
 	Color   string
 	Time    string
 	Role    CRole
+	ID      string `json:",omitempty"` // client ID of sender, set by server
 }
 
 // *** Room ***
@@ -89,6 +130,17 @@ const (
 	RStopped RoomStatus = "Stopped"
 )
 
+// How streamer sends its terminal
+type StreamMode string
+
+const (
+	// Output is sent in blocks, viewers render them with the delay of room
+	MBlock StreamMode = "Block"
+
+	// Each write is sent right away as TWrite and relayed to viewers, for pairing
+	MDirect StreamMode = "Direct"
+)
+
 type RoomInfo struct {
 	Id             uint64 // Id in DB
 	AccNViewers    uint64 // Accumulated nviewers
@@ -100,6 +152,8 @@ type RoomInfo struct {
 	Status         RoomStatus
 	Delay          uint64 // Viewer delay time with streamer ( in milliseconds )
 	Private        bool
+	Collaborators  []string // Name of viewers who have control of streamer's shell
+	Mode           StreamMode
 }
 
 // used for streamer to update room info
@@ -115,15 +169,62 @@ const (
 	RStreamerChat CRole = "StreamerChat" // Chat for streamer
 	RStreamer     CRole = "Streamer"     // Send content to server
 	RViewer       CRole = "Viewer"       // View content + chat
+	RCollaborator CRole = "Collaborator" // Viewer granted control of streamer's shell
 	RConsumerRTC  CRole = "RTCConsumer"  // Consumer only RTC connection : viewer listen to room voice chat
 	RProducerRTC  CRole = "RTCProducer"  // Publish of RTC conneciton: streamer publish voice in room
 )
 
+// Grant or revoke control of streamer's shell to the viewer with ID, viewers' IDs come with their chats
+// Revoke with an empty ID to take back control from all collaborators
+// Name is set by server when telling viewers about their control
+type Control struct {
+	ID      string `json:",omitempty"`
+	Name    string
+	Granted bool
+}
+
+type Pause struct {
+	Paused bool
+}
+
+// Sent by streamer when the program it streams exits
+type Close struct {
+	Command  string
+	ExitCode int
+}
+
+// What server does when a client's queue is full
+type Policy string
+
+const (
+	PDropOldest Policy = "DropOldest" // drop the oldest queued messages to make room, then send the current screen
+	PSnapshot   Policy = "Snapshot"   // drop queued stream messages and skip to the current screen
+	PDisconnect Policy = "Disconnect" // close connection with a reason, client can reconnect and resume
+)
+
 type ClientInfo struct {
 	Name   string
 	Role   CRole
 	Secret string // used to verify streamer
 	Key    string // used to access private room
+
+	// encoding of messages server sends to client, JSON by default
+	Encoding Encoding `json:",omitempty"`
+
+	// clients that don't send a protocol version speak version 1
+	ProtocolVersion int          `json:",omitempty"`
+	Capabilities    []Capability `json:",omitempty"`
+
+	// viewers that reconnect send seq of the last stream message they got
+	LastSeq uint64 `json:",omitempty"`
+
+	// viewers can choose what happens when they're too slow, server decides by default
+	Policy Policy `json:",omitempty"`
+}
+
+// Server tells client why it's rejected before closing the connection
+type Error struct {
+	Message string
 }
 
 // ** RTC ***
@@ -156,6 +257,22 @@ func Wrap(msgType MType, data interface{}) Wrapper {
 	return msg
 }
 
+// decode the Data field of a TWriteBlock message
+func ToTermWriteBlock(data interface{}) (TermWriteBlock, error) {
+	// already decoded from a binary frame
+	if block, ok := data.(TermWriteBlock); ok {
+		return block, nil
+	}
+
+	block := TermWriteBlock{}
+	var blockByte []byte
+	if err := ToStruct(data, &blockByte); err != nil {
+		return block, err
+	}
+	err := json.Unmarshal(blockByte, &block)
+	return block, err
+}
+
 // convert a map to struct
 // data is a map
 // v is a reference to a typed variable
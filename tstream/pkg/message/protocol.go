@@ -0,0 +1,46 @@
+/*
+Websocket protocol negotiation.
+Clients send their protocol version and capabilities in ClientInfo,
+server replies with a TProtocol message of what both sides support
+*/
+package message
+
+// Features a client can handle
+type Capability string
+
+const (
+	CBinary Capability = "Binary" // decode binary frames
+	CResume Capability = "Resume" // resume with sequence numbers after reconnecting
+	CDirect Capability = "Direct" // render stream messages outside blocks, needed for rooms in direct mode
+)
+
+// Capabilities server supports
+var CAPABILITIES = []Capability{CBinary, CResume, CDirect}
+
+type Protocol struct {
+	Version      int
+	Capabilities []Capability
+}
+
+func (p Protocol) Has(capability Capability) bool {
+	for _, c := range p.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Protocol both server and client support
+func Negotiate(server, client Protocol) Protocol {
+	negotiated := Protocol{Version: server.Version}
+	if client.Version < negotiated.Version {
+		negotiated.Version = client.Version
+	}
+	for _, c := range client.Capabilities {
+		if server.Has(c) {
+			negotiated.Capabilities = append(negotiated.Capabilities, c)
+		}
+	}
+	return negotiated
+}
@@ -14,7 +14,6 @@ import (
 	"os/exec"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 type PtyMaster struct {
@@ -47,14 +46,20 @@ func (pty *PtyMaster) StartShell(envVars []string) error {
 	if shell == "" {
 		shell = "bash"
 	}
+	return pty.StartCommand([]string{shell}, envVars)
+}
 
-	pty.cmd = exec.Command(shell)
+// Run a program with its arguments in pty
+func (pty *PtyMaster) StartCommand(command []string, envVars []string) error {
+	pty.cmd = exec.Command(command[0], command[1:]...)
 	pty.cmd.Env = append(os.Environ(), envVars...)
 
-	err := pty.StartCommand()
+	f, err := ptyDevice.Start(pty.cmd)
 	if err != nil {
 		return err
 	}
+	pty.f = f
+
 	// Set the initial window size
 	winSize, _ := GetWinsize(0)
 	pty.SetWinsize(winSize)
@@ -65,18 +70,14 @@ func (pty *PtyMaster) StartShell(envVars []string) error {
 	return nil
 }
 
-func (pty *PtyMaster) StartCommand() error {
-	f, err := ptyDevice.Start(pty.cmd)
-	if err != nil {
-		return err
-	}
-	pty.f = f
-	return nil
-}
-
 func (pty *PtyMaster) Stop() error {
 	signal.Ignore(syscall.SIGWINCH)
 
+	// no command has been started
+	if pty.cmd == nil || pty.cmd.Process == nil {
+		return nil
+	}
+
 	err := pty.cmd.Process.Signal(syscall.SIGTERM)
 	// TODO: Find a proper way to close the running command. Perhaps have a timeout after which,
 	// if the command hasn't reacted to SIGTERM, then send a SIGKILL
@@ -87,37 +88,24 @@ func (pty *PtyMaster) Stop() error {
 }
 
 func (pty *PtyMaster) Restore() {
-	term.Restore(0, pty.terminalInitState)
-}
-
-func (pty *PtyMaster) Refresh() {
-	// TODO: Find a better way to refresh instead of resizing
-	// We wanna force the app to re-draw itself, but there doesn't seem to be a way to do that
-	// so we fake it by resizing the window quickly, making it smaller and then back big
-	winSize, err := GetWinsize(0)
-	if err != nil {
-		return
-	}
-
-	winSize.Rows -= 1
-
-	if err != nil {
+	if pty.terminalInitState == nil {
 		return
 	}
-
-	pty.SetWinsize(winSize)
-	winSize.Rows += 1
-
-	go func() {
-		time.Sleep(time.Millisecond * 10)
-		pty.SetWinsize(winSize)
-	}()
+	term.Restore(0, pty.terminalInitState)
 }
 
 func (pty *PtyMaster) Wait() error {
 	return pty.cmd.Wait()
 }
 
+// Exit code of the program, -1 if it hasn't exited or was killed by a signal
+func (pty *PtyMaster) ExitCode() int {
+	if pty.cmd == nil || pty.cmd.ProcessState == nil {
+		return -1
+	}
+	return pty.cmd.ProcessState.ExitCode()
+}
+
 func (pty *PtyMaster) MakeRaw() error {
 	// Save the initial state of the terminal, before making it RAW. Note that this terminal is the
 	// terminal under which the tty-share command has been started, and it's identified via the
@@ -0,0 +1,30 @@
+package ptyMaster
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+// A single program runs in pty and reports how it exited
+func TestStartCommand(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	pty := New()
+	if code := pty.ExitCode(); code != -1 {
+		t.Errorf("Got exit code %d before starting, want -1", code)
+	}
+	if err := pty.StartCommand([]string{"sh", "-c", "echo hello; exit 3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// pty returns an error once the program closed it
+	output, _ := ioutil.ReadAll(pty)
+	pty.Wait()
+	if !strings.Contains(string(output), "hello") {
+		t.Errorf("Got output %q, want hello", output)
+	}
+	if code := pty.ExitCode(); code != 3 {
+		t.Errorf("Got exit code %d, want 3", code)
+	}
+}
@@ -0,0 +1,368 @@
+/*
+Recordings of rooms, written by the server and by streamers keeping a local copy.
+Persist every block and winsize message a room receives to a gzipped file so a session can be reviewed after it's stopped.
+Each record is a JSON encoded Wrapper, one per line.
+The Delay field of a record is the time offset (in milliseconds) since the recording started
+
+Every ROOM_KEYFRAME_INTERVAL the recorder starts a new gzip member with a snapshot of the terminal.
+The position of each snapshot is stored in an index file next to the recording,
+so a replay can start decompressing from any keyframe instead of from the beginning
+*/
+package record
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 20 min of asciiquarium generate 10mins of playback
+type Recorder struct {
+	lock      sync.Mutex
+	path      string
+	startTime time.Time
+	f         *F
+	index     *os.File
+
+	// keep track of the screen to take keyframes
+	emulator         *emulator.Emulator
+	lastKeyframeTime time.Time
+}
+
+// A keyframe entry in index file
+type Keyframe struct {
+	Delay int64 // milliseconds since the recording started
+	Pos   int64 // byte offset of the gzip member that starts with this keyframe
+}
+
+// Path of the recording file for room with id in the records directory
+func Path(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.gz", id))
+}
+
+// Path of the keyframe index file of a recording
+func IndexPath(recordPath string) string {
+	return strings.TrimSuffix(recordPath, filepath.Ext(recordPath)) + ".idx"
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		log.Printf("Failed to create record directory: %s", err)
+		return nil, err
+	}
+
+	f, err := CreateGZ(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(IndexPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		log.Printf("Failed to create index file: %s", err)
+		CloseGZ(f)
+		return nil, err
+	}
+
+	return &Recorder{
+		f:                &f,
+		index:            index,
+		path:             path,
+		startTime:        time.Now(),
+		emulator:         emulator.New(emulator.DEFAULT_COLS, emulator.DEFAULT_ROWS),
+		lastKeyframeTime: time.Now(),
+	}, nil
+}
+
+func (re *Recorder) Path() string {
+	return re.path
+}
+
+func (re *Recorder) StartTime() time.Time {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	return re.startTime
+}
+
+// Continue the timing of an earlier recording appended to the same file
+func (re *Recorder) SetStartTime(t time.Time) {
+	re.lock.Lock()
+	re.startTime = t
+	re.lock.Unlock()
+}
+
+// Stamp the message with its offset since the recording started and append it to file
+func (re *Recorder) WriteMsg(msg message.Wrapper) error {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+
+	if re.f == nil {
+		return fmt.Errorf("Recorder is closed")
+	}
+
+	if err := re.emulator.WriteMsg(msg); err != nil {
+		log.Printf("Failed to emulate message: %s", err)
+	}
+
+	if err := re.write(msg); err != nil {
+		return err
+	}
+
+	if time.Since(re.lastKeyframeTime) > cfg.ROOM_KEYFRAME_INTERVAL*time.Second {
+		if err := re.writeKeyframe(); err != nil {
+			log.Printf("Failed to write keyframe: %s", err)
+		}
+	}
+	return nil
+}
+
+func (re *Recorder) write(msg message.Wrapper) error {
+	msg.Delay = time.Since(re.startTime).Milliseconds()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode message")
+		return err
+	}
+
+	err = WriteGZ(*re.f, append(data, '\n'))
+	if err != nil {
+		log.Printf("Failed to write message: %s", err)
+		return err
+	}
+	return nil
+}
+
+// Start a new gzip member with a snapshot of the terminal and add it to index
+func (re *Recorder) writeKeyframe() error {
+	re.lastKeyframeTime = time.Now()
+
+	pos, err := NewMemberGZ(*re.f)
+	if err != nil {
+		return err
+	}
+
+	msg := message.Wrapper{Type: message.TSnapshot, Data: re.emulator.Snapshot()}
+	if err := re.write(msg); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(Keyframe{Delay: time.Since(re.startTime).Milliseconds(), Pos: pos})
+	if err != nil {
+		return err
+	}
+	_, err = re.index.Write(append(data, '\n'))
+	return err
+}
+
+// Flush all buffered messages to disk and close the file
+// Safe to call multiple times
+func (re *Recorder) Close() error {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+
+	if re.f == nil {
+		return nil
+	}
+	re.index.Close()
+	err := CloseGZ(*re.f)
+	re.f = nil
+	return err
+}
+
+type F struct {
+	f  *os.File
+	gf *gzip.Writer
+	bf *bufio.Writer
+}
+
+func CreateGZ(path string) (F, error) {
+	var f F
+	fi, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		log.Printf("Failed to create file: %s", err)
+		return f, err
+	}
+	gf := gzip.NewWriter(fi)
+	bf := bufio.NewWriter(gf)
+	f = F{fi, gf, bf}
+	return f, nil
+}
+
+func WriteGZ(f F, data []byte) error {
+	n, err := f.bf.Write(data)
+	if n != len(data) || err != nil {
+		log.Printf("Failed to write data %s", err)
+		return err
+	}
+	return nil
+}
+
+// Finish the current gzip member and start a new one
+// Return the byte offset the new member starts at
+func NewMemberGZ(f F) (int64, error) {
+	if err := f.bf.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.gf.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	f.gf.Reset(f.f)
+	f.bf.Reset(f.gf)
+	return info.Size(), nil
+}
+
+// Flush buffered data, write the gzip footer and close the underlying file
+func CloseGZ(f F) error {
+	if err := f.bf.Flush(); err != nil {
+		log.Printf("Failed to flush data: %s", err)
+		f.gf.Close()
+		f.f.Close()
+		return err
+	}
+
+	if err := f.gf.Close(); err != nil {
+		log.Printf("Failed to close gzip writer: %s", err)
+		f.f.Close()
+		return err
+	}
+
+	return f.f.Close()
+}
+
+// Read messages from a recording file in the order they were recorded
+type Reader struct {
+	f   *os.File
+	gf  *gzip.Reader
+	dec *json.Decoder
+}
+
+func Open(path string) (*Reader, error) {
+	return OpenAt(path, 0)
+}
+
+// Start reading from a gzip member at byte offset pos
+func OpenAt(path string, pos int64) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	gf, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Reader{
+		f:   f,
+		gf:  gf,
+		dec: json.NewDecoder(gf),
+	}, nil
+}
+
+// Return io.EOF when there is no message left
+func (rr *Reader) Next() (message.Wrapper, error) {
+	msg := message.Wrapper{}
+	err := rr.dec.Decode(&msg)
+	// a recording of a server that died mid session doesn't have the gzip footer
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return msg, err
+}
+
+func (rr *Reader) Close() error {
+	rr.gf.Close()
+	return rr.f.Close()
+}
+
+// Find the latest keyframe at or before time t (in milliseconds)
+// Return a keyframe at the start of the recording if there is none
+func FindKeyframe(recordPath string, t int64) Keyframe {
+	keyframe := Keyframe{}
+	f, err := os.Open(IndexPath(recordPath))
+	if err != nil {
+		return keyframe
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		kf := Keyframe{}
+		if err := dec.Decode(&kf); err != nil || kf.Delay > t {
+			return keyframe
+		}
+		keyframe = kf
+	}
+}
+
+// Read keyframes of an index that doesn't come from this server, like one uploaded by streamer
+// Each keyframe has to start a gzip member of the recording at path, in the order of the recording
+func ReadIndex(r io.Reader, path string) ([]Keyframe, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var keyframes []Keyframe
+	last := Keyframe{Delay: -1, Pos: -1}
+	dec := json.NewDecoder(r)
+	for {
+		kf := Keyframe{}
+		if err := dec.Decode(&kf); err == io.EOF {
+			return keyframes, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if kf.Pos <= last.Pos || kf.Pos >= info.Size() || kf.Delay < last.Delay {
+			return nil, fmt.Errorf("Keyframe at %d is out of order or outside of recording", kf.Pos)
+		}
+		if _, err := gzip.NewReader(io.NewSectionReader(f, kf.Pos, info.Size()-kf.Pos)); err != nil {
+			return nil, fmt.Errorf("Keyframe at %d doesn't start a gzip member: %s", kf.Pos, err)
+		}
+		keyframes = append(keyframes, kf)
+		last = kf
+	}
+}
+
+func WriteIndex(path string, keyframes []Keyframe) error {
+	f, err := os.Create(IndexPath(path))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, kf := range keyframes {
+		if err := enc.Encode(kf); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
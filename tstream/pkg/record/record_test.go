@@ -0,0 +1,103 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+func readAll(t *testing.T, reader *Reader) []message.Wrapper {
+	t.Helper()
+	defer reader.Close()
+	var msgs []message.Wrapper
+	for {
+		msg, err := reader.Next()
+		if err == io.EOF {
+			return msgs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	path := filepath.Join(t.TempDir(), "records", "1.gz")
+	re, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(data string) {
+		if err := re.WriteMsg(message.Wrapper{Type: message.TWrite, Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("before\r\n")
+	time.Sleep(10 * time.Millisecond)
+	re.lock.Lock()
+	if err := re.writeKeyframe(); err != nil {
+		t.Fatal(err)
+	}
+	re.lock.Unlock()
+	write("after\r\n")
+	if err := re.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := re.WriteMsg(message.Wrapper{Type: message.TWrite}); err == nil {
+		t.Error("Wrote to a closed recorder")
+	}
+
+	// messages are stamped with their time in recording, the keyframe has the screen so far
+	msgs := readAll(t, mustOpen(t, path, 0))
+	if len(msgs) != 3 || msgs[0].Type != message.TWrite || msgs[1].Type != message.TSnapshot || msgs[2].Type != message.TWrite {
+		t.Fatalf("Got %v, want write, snapshot and write", msgs)
+	}
+	if msgs[1].Delay < 10 || msgs[2].Delay < msgs[1].Delay {
+		t.Errorf("Got delays %d, %d and %d, want them increasing", msgs[0].Delay, msgs[1].Delay, msgs[2].Delay)
+	}
+	snapshot := message.Snapshot{}
+	if err := message.ToStruct(msgs[1].Data, &snapshot); err != nil || !bytes.Contains(snapshot.Data, []byte("before")) {
+		t.Errorf("Got snapshot %q: %v, want the screen before keyframe", snapshot.Data, err)
+	}
+
+	// seeking starts from the keyframe
+	kf := FindKeyframe(path, msgs[2].Delay)
+	if kf.Pos == 0 || kf.Delay < msgs[1].Delay || kf.Delay > msgs[2].Delay {
+		t.Fatalf("Got keyframe %+v, want the one at %dms", kf, msgs[1].Delay)
+	}
+	if msgs := readAll(t, mustOpen(t, path, kf.Pos)); len(msgs) != 2 || msgs[0].Type != message.TSnapshot {
+		t.Errorf("Got %v from keyframe, want snapshot and write", msgs)
+	}
+	if kf := FindKeyframe(path, 0); kf.Pos != 0 {
+		t.Errorf("Got keyframe %+v before the first one, want start of recording", kf)
+	}
+
+	// an index server gets with the recording is the same one recorder wrote
+	index, err := os.Open(IndexPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	keyframes, err := ReadIndex(index, path)
+	if err != nil || len(keyframes) != 1 || keyframes[0] != kf {
+		t.Errorf("Got index %v: %v, want %v", keyframes, err, kf)
+	}
+}
+
+func mustOpen(t *testing.T, path string, pos int64) *Reader {
+	t.Helper()
+	reader, err := OpenAt(path, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
@@ -0,0 +1,131 @@
+package room
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+const benchViewers = 1000
+
+var upgrader = websocket.Upgrader{}
+
+// Room with n viewers connected through real websockets
+// received is done once for every message a viewer reads
+func benchRoom(b *testing.B, n int, encoding message.Encoding, received *sync.WaitGroup) *Room {
+	// clients log when they are closed, which keeps happening after the benchmark
+	log.SetOutput(ioutil.Discard)
+
+	conns := make(chan *websocket.Conn, n)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Errorf("Failed to upgrade: %s", err)
+			return
+		}
+		conns <- conn
+	}))
+	b.Cleanup(server.Close)
+
+	room := New("bench", "bench", "secret")
+	for i := 0; i < n; i++ {
+		viewer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			b.Fatalf("Failed to connect viewer: %s", err)
+		}
+		b.Cleanup(func() { viewer.Close() })
+		go func() {
+			for {
+				if _, _, err := viewer.ReadMessage(); err != nil {
+					return
+				}
+				received.Done()
+			}
+		}()
+
+		cl := NewClient(message.RViewer, <-conns)
+		cl.SetEncoding(encoding)
+		go cl.Start()
+		room.clients[fmt.Sprint(i)] = cl
+	}
+	return room
+}
+
+// A block of a busy terminal
+func benchBlock(b *testing.B) message.Wrapper {
+	var queue [][]byte
+	for i := 0; i < 100; i++ {
+		data, _ := json.Marshal(message.Wrapper{
+			Type:  message.TWrite,
+			Data:  []byte(fmt.Sprintf("\x1b[32m%d\x1b[0m building package %d of 100 ...\r\n", i, i)),
+			Delay: int64(i * 10),
+		})
+		queue = append(queue, data)
+	}
+	block, err := message.EncodeBlock(queue, time.Now(), time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return block
+}
+
+// CPU time used by the process
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// Report cost of sending a message to one viewer, measured until every viewer received it
+// CPU time includes viewers reading messages, which is the same for every way of sending
+func benchBroadcast(b *testing.B, encoding message.Encoding, send func(room *Room, msg message.Wrapper)) {
+	var received sync.WaitGroup
+	room := benchRoom(b, benchViewers, encoding, &received)
+	msg := benchBlock(b)
+
+	b.ResetTimer()
+	start, startCPU := time.Now(), cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		received.Add(benchViewers)
+		send(room, msg)
+		received.Wait()
+	}
+	b.StopTimer()
+	n := float64(b.N * benchViewers)
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/n, "ns/viewer")
+	b.ReportMetric(float64((cpuTime(b)-startCPU).Nanoseconds())/n, "cpu-ns/viewer")
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	roles := []message.CRole{message.RViewer}
+	for _, encoding := range []message.Encoding{message.EJSON, message.EBinary} {
+		// Encoded once for all viewers
+		b.Run(fmt.Sprintf("%s/Prepared", encoding), func(b *testing.B) {
+			benchBroadcast(b, encoding, func(room *Room, msg message.Wrapper) {
+				room.Broadcast(msg, roles, nil)
+			})
+		})
+
+		// Encoded for each viewer, like broadcasting without frames
+		b.Run(fmt.Sprintf("%s/PerViewer", encoding), func(b *testing.B) {
+			benchBroadcast(b, encoding, func(room *Room, msg message.Wrapper) {
+				for _, client := range room.clients {
+					client.Out <- NewFrame(msg)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Recent stream messages of a room.
+Each message gets a sequence number so viewers that reconnect
+can get exactly the messages they missed
+*/
+package room
+
+import (
+	"sync"
+
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+type streamBuffer struct {
+	lock sync.Mutex
+	msgs []*Frame // ring of the most recent messages
+	next int      // where the next message goes in ring
+	seq  uint64   // sequence number of the last message
+}
+
+func newStreamBuffer(size int) *streamBuffer {
+	return &streamBuffer{msgs: make([]*Frame, size)}
+}
+
+// Assign the next sequence number to msg and keep it
+// Frames are kept so resuming viewers reuse their encoding
+func (b *streamBuffer) Add(msg message.Wrapper) *Frame {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.seq++
+	msg.Seq = b.seq
+	frame := NewFrame(msg)
+	b.msgs[b.next] = frame
+	b.next = (b.next + 1) % len(b.msgs)
+	return frame
+}
+
+func (b *streamBuffer) Seq() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.seq
+}
+
+// Messages after seq in order
+// Return false if some of them are no longer in buffer
+func (b *streamBuffer) Since(seq uint64) ([]*Frame, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if seq > b.seq || b.seq-seq > uint64(len(b.msgs)) {
+		return nil, false
+	}
+
+	n := int(b.seq - seq)
+	msgs := make([]*Frame, 0, n)
+	for i := n; i > 0; i-- {
+		msgs = append(msgs, b.msgs[(b.next-i+len(b.msgs))%len(b.msgs)])
+	}
+	return msgs, true
+}
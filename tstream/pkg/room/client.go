@@ -1,6 +1,7 @@
 /*
 Generic struct for a websocket connection
 Currently used for Viewer and Chat
+Clients without connection are local clients, served in server process
 */
 package room
 
@@ -9,56 +10,155 @@ import (
 	"github.com/qnkhuat/tstream/internal/cfg"
 	"github.com/qnkhuat/tstream/pkg/message"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Client struct {
+	lock sync.Mutex
 	conn *websocket.Conn
 	role message.CRole
+	name string // name of client in chat
+
+	// encoding of messages sent to client
+	encoding message.Encoding
 
 	// data go in Out channel will be send to user via websocket
-	Out chan message.Wrapper
+	Out chan *Frame
 
 	// Data sent from user will be stored in In channel
 	In chan message.Wrapper
 
+	// applied when Out is full, so a slow client can't hold up the room
+	policy   message.Policy
+	snapshot func() (*Frame, error) // current screen to make up for dropped stream messages
+	resynced *Frame                 // last snapshot queued after dropping stream messages
+	dropped  uint64                 // number of messages dropped, accessed atomically
+
 	lastActiveTime time.Time
+	alive          bool
 
-	alive bool
+	// closed when client is closed
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewClient(role message.CRole, conn *websocket.Conn) *Client {
-	out := make(chan message.Wrapper, 256) // buffer 256 send requests
-	in := make(chan message.Wrapper, 256)  // buffer 256 send requests
+	out := make(chan *Frame, 256)         // buffer 256 send requests
+	in := make(chan message.Wrapper, 256) // buffer 256 send requests
 	return &Client{
-		conn:  conn,
-		Out:   out,
-		In:    in,
-		role:  role,
-		alive: true,
+		conn:   conn,
+		Out:    out,
+		In:     in,
+		role:   role,
+		policy: message.PDropOldest,
+		alive:  true,
+		done:   make(chan struct{}),
+
+		lastActiveTime: time.Now(),
 	}
 }
 
 func (cl *Client) Role() message.CRole {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
 	return cl.role
 }
 
+func (cl *Client) SetRole(role message.CRole) {
+	cl.lock.Lock()
+	cl.role = role
+	cl.lock.Unlock()
+}
+
+func (cl *Client) Name() string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.name
+}
+
+func (cl *Client) SetName(name string) {
+	cl.lock.Lock()
+	cl.name = name
+	cl.lock.Unlock()
+}
+
+func (cl *Client) SetEncoding(encoding message.Encoding) {
+	cl.lock.Lock()
+	cl.encoding = encoding
+	cl.lock.Unlock()
+}
+
+func (cl *Client) SetPolicy(policy message.Policy) {
+	cl.lock.Lock()
+	cl.policy = policy
+	cl.lock.Unlock()
+}
+
+// Without it PSnapshot falls back to PDropOldest and dropped stream messages are lost
+func (cl *Client) SetSnapshot(snapshot func() (*Frame, error)) {
+	cl.lock.Lock()
+	cl.snapshot = snapshot
+	cl.lock.Unlock()
+}
+
+// Number of messages dropped because client was too slow
+func (cl *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&cl.dropped)
+}
+
 func (cl *Client) Alive() bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
 	return cl.alive
 }
 
+// Return false if client was already dead
+func (cl *Client) kill() bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	alive := cl.alive
+	cl.alive = false
+	return alive
+}
+
+func (cl *Client) touch() {
+	cl.lock.Lock()
+	cl.lastActiveTime = time.Now()
+	cl.lock.Unlock()
+}
+
+func (cl *Client) idle() time.Duration {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return time.Since(cl.lastActiveTime)
+}
+
+// Closed when the connection to client is closed
+func (cl *Client) Done() <-chan struct{} {
+	return cl.done
+}
+
 func (cl *Client) Start() {
 	cl.conn.SetPongHandler(func(appData string) error {
-		cl.lastActiveTime = time.Now()
+		cl.touch()
 		return nil
 	})
 
 	// periodically ping client
 	go func() {
-		for _ = range time.Tick(cfg.SERVER_PING_INTERVAL * time.Second) {
+		ticker := time.NewTicker(cfg.SERVER_PING_INTERVAL * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-cl.done:
+				return
+			}
 			cl.conn.WriteControl(websocket.PingMessage, emptyByteArray, time.Time{})
-			if time.Now().Sub(cl.lastActiveTime) > time.Second*cfg.SERVER_DISCONNECTED_THRESHHOLD {
-				cl.alive = false
+			if cl.idle() > time.Second*cfg.SERVER_DISCONNECTED_THRESHHOLD {
+				cl.kill()
 				cl.conn.Close()
 				log.Printf("Closing client role: %s due to inactive", cl.Role())
 				return
@@ -69,10 +169,16 @@ func (cl *Client) Start() {
 	// Receive message coroutine
 	go func() {
 		for {
-			msg, ok := <-cl.Out
-			cl.lastActiveTime = time.Now()
+			var frame *Frame
+			var ok bool
+			select {
+			case frame, ok = <-cl.Out:
+			case <-cl.done:
+				return
+			}
+			cl.touch()
 			if ok {
-				err := cl.conn.WriteJSON(msg)
+				err := cl.write(frame)
 				if err != nil {
 					log.Printf("Failed to boardcast to. Closing connection")
 					cl.Close()
@@ -88,8 +194,7 @@ func (cl *Client) Start() {
 
 	// Send message coroutine
 	for {
-		msg := message.Wrapper{}
-		err := cl.conn.ReadJSON(&msg)
+		msg, err := cl.read()
 		if err == nil {
 			cl.In <- msg // Will be handled in Room
 		} else {
@@ -100,10 +205,177 @@ func (cl *Client) Start() {
 	}
 }
 
+// Queue frame without blocking
+// When the queue is full, client's policy decides what to drop
+func (cl *Client) Send(frame *Frame) {
+	select {
+	case cl.Out <- frame:
+		return
+	default:
+	}
+
+	cl.lock.Lock()
+	policy, snapshot := cl.policy, cl.snapshot
+	cl.lock.Unlock()
+
+	switch {
+	case policy == message.PDisconnect:
+		atomic.AddUint64(&cl.dropped, 1)
+		if cl.kill() {
+			// closing can take a while, don't hold up the sender
+			go cl.Evict("Connection is too slow to keep up with the stream")
+		}
+
+	case policy == message.PSnapshot && snapshot != nil:
+		cl.skipToSnapshot(frame, snapshot)
+
+	default:
+		if cl.push(frame) && snapshot != nil {
+			cl.resync(snapshot)
+		}
+	}
+}
+
+// Queue frame, dropping the oldest queued messages to make room
+// Return true if it dropped stream messages no queued snapshot includes
+func (cl *Client) push(frame *Frame) bool {
+	missed := false
+	for {
+		select {
+		case cl.Out <- frame:
+			return missed
+		default:
+		}
+
+		select {
+		case dropped := <-cl.Out:
+			atomic.AddUint64(&cl.dropped, 1)
+			// only stream messages are numbered
+			if dropped.Msg.Seq > 0 && !cl.resyncedAfter(dropped) {
+				missed = true
+			}
+		default:
+		}
+	}
+}
+
+// Whether the last resync snapshot is still queued after dropped and includes it
+func (cl *Client) resyncedAfter(dropped *Frame) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.resynced != nil && cl.resynced != dropped && dropped.Msg.Seq <= cl.resynced.Msg.Seq
+}
+
+// Queue the current screen after dropping stream messages so client doesn't go out of sync
+func (cl *Client) resync(snapshot func() (*Frame, error)) {
+	current, err := snapshot()
+	if err != nil {
+		log.Printf("Failed to create snapshot for slow client: %s", err)
+		return
+	}
+	cl.lock.Lock()
+	cl.resynced = current
+	cl.lock.Unlock()
+	// messages dropped for it are older, so it includes them
+	cl.push(current)
+}
+
+// Replace queued stream messages with the current screen, which already includes them
+// Other messages like chat are kept
+func (cl *Client) skipToSnapshot(frame *Frame, snapshot func() (*Frame, error)) {
+	current, err := snapshot()
+	if err != nil {
+		log.Printf("Failed to create snapshot for slow client: %s", err)
+		cl.push(frame)
+		return
+	}
+	log.Printf("Client role: %s is too slow, skipping to the current screen", cl.Role())
+
+	var kept []*Frame
+	for _, queued := range append(cl.drain(), frame) {
+		// only stream messages are numbered
+		if queued.Msg.Seq > 0 {
+			atomic.AddUint64(&cl.dropped, 1)
+		} else {
+			kept = append(kept, queued)
+		}
+	}
+
+	cl.push(current)
+	for _, queued := range kept {
+		cl.push(queued)
+	}
+}
+
+// Take all queued messages out of Out
+func (cl *Client) drain() []*Frame {
+	var frames []*Frame
+	for {
+		select {
+		case frame := <-cl.Out:
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+}
+
+func (cl *Client) write(frame *Frame) error {
+	cl.lock.Lock()
+	encoding := cl.encoding
+	cl.lock.Unlock()
+
+	prepared, err := frame.Prepared(encoding)
+	if err != nil {
+		// skip the message instead of dropping the client
+		log.Printf("Failed to encode message: %s", err)
+		return nil
+	}
+	return cl.conn.WritePreparedMessage(prepared)
+}
+
+// Clients can send messages in either encoding
+func (cl *Client) read() (message.Wrapper, error) {
+	msgType, data, err := cl.conn.ReadMessage()
+	if err != nil {
+		return message.Wrapper{}, err
+	}
+	return message.Decode(data, msgType == websocket.BinaryMessage)
+}
+
 func (cl *Client) Close() {
 	log.Printf("Closing client")
-	cl.conn.WriteControl(websocket.CloseMessage, emptyByteArray, time.Time{})
-	time.Sleep(1 * time.Second) // wait for client to receive close message
-	cl.alive = false
-	cl.conn.Close()
+	cl.kill()
+	cl.closeOnce.Do(func() {
+		// local clients don't have a connection
+		if cl.conn == nil {
+			close(cl.done)
+			return
+		}
+		// Wait in background so closing every client of a room doesn't add up
+		go func() {
+			// Let messages queued before closing reach client, like the last output of streamer
+			deadline := time.Now().Add(1 * time.Second)
+			for len(cl.Out) > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			cl.conn.WriteControl(websocket.CloseMessage, emptyByteArray, time.Time{})
+			time.Sleep(1 * time.Second) // wait for client to receive close message
+			cl.conn.Close()
+			close(cl.done)
+		}()
+	})
+}
+
+// Disconnect client right away without waiting for queued messages, telling it why
+func (cl *Client) Evict(reason string) {
+	log.Printf("Evicting client role: %s. Reason: %s", cl.Role(), reason)
+	cl.kill()
+	// local clients don't have a connection
+	if cl.conn != nil {
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason)
+		cl.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		cl.conn.Close()
+	}
+	cl.closeOnce.Do(func() { close(cl.done) })
 }
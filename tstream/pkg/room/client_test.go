@@ -0,0 +1,81 @@
+package room
+
+import (
+	"testing"
+
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Client whose queue is already full of stream messages 1 to cap(Out)
+func slowClient(t *testing.T, policy message.Policy) *Client {
+	cl := NewClient(message.RViewer, nil)
+	cl.SetPolicy(policy)
+	for seq := 1; seq <= cap(cl.Out); seq++ {
+		cl.Send(NewFrame(message.Wrapper{Type: message.TWriteBlock, Seq: uint64(seq)}))
+	}
+	if cl.Dropped() != 0 {
+		t.Fatalf("Dropped %d messages before queue is full", cl.Dropped())
+	}
+	return cl
+}
+
+func TestSendDropOldest(t *testing.T) {
+	cl := slowClient(t, message.PDropOldest)
+	snapshots := 0
+	cl.SetSnapshot(func() (*Frame, error) {
+		snapshots++
+		return NewFrame(message.Wrapper{Type: message.TWriteBlock, Seq: uint64(cap(cl.Out))}), nil
+	})
+	// the first drop needs a snapshot to make up for it, the ones after are older than the snapshot
+	cl.Send(NewFrame(message.Wrapper{Type: message.TChat}))
+	cl.Send(NewFrame(message.Wrapper{Type: message.TChat}))
+
+	if cl.Dropped() != 3 || snapshots != 1 {
+		t.Errorf("Dropped %d messages with %d snapshots, want 3 and 1", cl.Dropped(), snapshots)
+	}
+	if frame := <-cl.Out; frame.Msg.Seq != 4 {
+		t.Errorf("First queued message is %d, want 4", frame.Msg.Seq)
+	}
+	queued := cl.drain()
+	var types []message.MType
+	for _, frame := range queued[len(queued)-3:] {
+		types = append(types, frame.Msg.Type)
+	}
+	if types[0] != message.TChat || types[1] != message.TWriteBlock || types[2] != message.TChat {
+		t.Errorf("Last queued messages are %v, want chat, snapshot and chat", types)
+	}
+}
+
+func TestSendSnapshot(t *testing.T) {
+	cl := slowClient(t, message.PSnapshot)
+	cl.SetSnapshot(func() (*Frame, error) {
+		return NewFrame(message.Wrapper{Type: message.TWriteBlock, Seq: uint64(cap(cl.Out) + 1)}), nil
+	})
+	cl.Send(NewFrame(message.Wrapper{Type: message.TChat}))
+
+	if cl.Dropped() != uint64(cap(cl.Out)) {
+		t.Errorf("Dropped %d messages, want %d", cl.Dropped(), cap(cl.Out))
+	}
+	if len(cl.Out) != 2 {
+		t.Fatalf("Queued %d messages, want the snapshot and chat", len(cl.Out))
+	}
+	if frame := <-cl.Out; frame.Msg.Seq != uint64(cap(cl.Out)+1) {
+		t.Errorf("First queued message is %d, want the snapshot", frame.Msg.Seq)
+	}
+	if frame := <-cl.Out; frame.Msg.Type != message.TChat {
+		t.Errorf("Second queued message is %s, want chat", frame.Msg.Type)
+	}
+}
+
+func TestSendDisconnect(t *testing.T) {
+	cl := slowClient(t, message.PDisconnect)
+	cl.Send(NewFrame(message.Wrapper{Type: message.TChat}))
+
+	<-cl.Done()
+	if cl.Alive() {
+		t.Error("Slow client is still alive")
+	}
+	if cl.Dropped() != 1 {
+		t.Errorf("Dropped %d messages, want 1", cl.Dropped())
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Convert recordings to formats that can be played by other tools
+*/
+package room
+
+import (
+	"io"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/asciicast"
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+)
+
+// Convert a recording to an asciicast v2 file
+func ExportAsciicast(recordPath string, info message.RoomInfo, w io.Writer) error {
+	winsize := firstWinsize(recordPath)
+	if winsize.Cols == 0 || winsize.Rows == 0 {
+		winsize = message.Winsize{Cols: emulator.DEFAULT_COLS, Rows: emulator.DEFAULT_ROWS}
+	}
+
+	reader, err := record.Open(recordPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := asciicast.NewWriter(w, asciicast.Header{
+		Width:     int(winsize.Cols),
+		Height:    int(winsize.Rows),
+		Timestamp: info.StartedTime.Unix(),
+		Title:     info.Title,
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		startTime time.Time
+		lastTime  float64
+		pending   []byte // bytes of an utf8 rune that is split between two writes
+	)
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var msgs []message.Wrapper
+		var timeOf func(msg message.Wrapper) time.Time
+
+		switch {
+		case record.Type == message.TWriteBlock:
+			block, err := message.ToTermWriteBlock(record.Data)
+			if err != nil {
+				return err
+			}
+
+			msgs, err = message.DecodeBlock(block)
+			if err != nil {
+				return err
+			}
+
+			// Streamer offsets messages by (delay - duration) so viewers can schedule them
+			timeOf = func(msg message.Wrapper) time.Time {
+				return block.StartTime.Add(time.Duration(msg.Delay-int64(info.Delay)+block.Duration) * time.Millisecond)
+			}
+
+		case info.Mode == message.MDirect:
+			// Streamer in direct mode sends messages one by one, recorded with their offset in recording
+			msgs = []message.Wrapper{record}
+			timeOf = func(msg message.Wrapper) time.Time {
+				return info.StartedTime.Add(time.Duration(msg.Delay) * time.Millisecond)
+			}
+
+		default:
+			// Winsize records are duplicated inside blocks
+			continue
+		}
+
+		for _, msg := range msgs {
+			msgTime := timeOf(msg)
+			if startTime.IsZero() {
+				startTime = msgTime
+			}
+
+			event := asciicast.Event{Time: msgTime.Sub(startTime).Seconds()}
+			if event.Time < lastTime {
+				event.Time = lastTime
+			}
+			lastTime = event.Time
+
+			switch msg.Type {
+
+			case message.TWrite:
+				var data []byte
+				if err := message.ToStruct(msg.Data, &data); err != nil {
+					return err
+				}
+				data = append(pending, data...)
+				cut := len(data) - emulator.IncompleteRuneLen(data)
+				pending = append([]byte{}, data[cut:]...)
+				if cut == 0 {
+					continue
+				}
+				event.Type = asciicast.EOutput
+				event.Data = string(data[:cut])
+
+			case message.TWinsize:
+				ws := message.Winsize{}
+				if err := message.ToStruct(msg.Data, &ws); err != nil {
+					return err
+				}
+				event.Type = asciicast.EResize
+				event.Data = asciicast.ResizeData(ws.Cols, ws.Rows)
+
+			default:
+				continue
+			}
+
+			if err := writer.WriteEvent(event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package room
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/asciicast"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+)
+
+func writeRecording(t *testing.T, msgs ...message.Wrapper) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "record.gz")
+	f, err := record.CreateGZ(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		data, _ := json.Marshal(msg)
+		if err := record.WriteGZ(f, append(data, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := record.CloseGZ(f); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Block of writes at offsets (in milliseconds) since start, the way streamer stamps them
+func exportBlock(t *testing.T, start time.Time, duration, delay int64, offsets []int64, writes []string) message.Wrapper {
+	t.Helper()
+	var queue [][]byte
+	for i, offset := range offsets {
+		data, _ := json.Marshal(message.Wrapper{Type: message.TWrite, Data: []byte(writes[i]), Delay: offset + delay - duration})
+		queue = append(queue, data)
+	}
+	block, err := message.EncodeBlock(queue, start, time.Duration(duration)*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func exportEvents(t *testing.T, path string, info message.RoomInfo) (asciicast.Header, []asciicast.Event) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := ExportAsciicast(path, info, &out); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := asciicast.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []asciicast.Event
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			return reader.Header(), events
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+}
+
+func checkEvents(t *testing.T, got, want []asciicast.Event) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Got %d events %v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i].Type != want[i].Type || got[i].Data != want[i].Data || math.Abs(got[i].Time-want[i].Time) > 0.001 {
+			t.Errorf("Event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestExportBlocks(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	info := message.RoomInfo{Title: "blocks", Delay: 1500, Mode: message.MBlock, StartedTime: start}
+	path := writeRecording(t,
+		message.Wrapper{Type: message.TWinsize, Data: message.Winsize{Rows: 30, Cols: 100}},
+		exportBlock(t, start, 1000, 1500, []int64{0, 250}, []string{"one", "caf\xc3"}),
+		exportBlock(t, start.Add(time.Second), 1000, 1500, []int64{500}, []string{"\xa9 two"}),
+	)
+
+	header, events := exportEvents(t, path, info)
+	if header.Width != 100 || header.Height != 30 || header.Timestamp != start.Unix() {
+		t.Errorf("Got header %+v, want the first winsize and start time", header)
+	}
+	// events keep the timing in blocks, a character split between writes is joined
+	checkEvents(t, events, []asciicast.Event{
+		{Time: 0, Type: asciicast.EOutput, Data: "one"},
+		{Time: 0.25, Type: asciicast.EOutput, Data: "caf"},
+		{Time: 1.5, Type: asciicast.EOutput, Data: "é two"},
+	})
+}
+
+func TestExportDirect(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	info := message.RoomInfo{Title: "direct", Mode: message.MDirect, StartedTime: start}
+	path := writeRecording(t,
+		message.Wrapper{Type: message.TWinsize, Data: message.Winsize{Rows: 30, Cols: 100}, Delay: 100},
+		message.Wrapper{Type: message.TWrite, Data: []byte("one"), Delay: 100},
+		message.Wrapper{Type: message.TWrite, Data: []byte("two"), Delay: 350},
+	)
+
+	_, events := exportEvents(t, path, info)
+	checkEvents(t, events, []asciicast.Event{
+		{Time: 0, Type: asciicast.EResize, Data: asciicast.ResizeData(100, 30)},
+		{Time: 0, Type: asciicast.EOutput, Data: "one"},
+		{Time: 0.25, Type: asciicast.EOutput, Data: "two"},
+	})
+}
@@ -0,0 +1,60 @@
+/*
+Message to send to clients.
+A frame is encoded once for each encoding no matter how many clients it's broadcast to
+*/
+package room
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+type Frame struct {
+	Msg message.Wrapper
+
+	lock     sync.Mutex
+	prepared map[message.Encoding]*websocket.PreparedMessage
+}
+
+func NewFrame(msg message.Wrapper) *Frame {
+	return &Frame{
+		Msg:      msg,
+		prepared: make(map[message.Encoding]*websocket.PreparedMessage),
+	}
+}
+
+// Encode the message on first call, later calls reuse it
+func (f *Frame) Prepared(encoding message.Encoding) (*websocket.PreparedMessage, error) {
+	if encoding != message.EBinary {
+		encoding = message.EJSON
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if prepared, ok := f.prepared[encoding]; ok {
+		return prepared, nil
+	}
+
+	var data []byte
+	var err error
+	msgType := websocket.TextMessage
+	if encoding == message.EBinary {
+		msgType = websocket.BinaryMessage
+		data, err = message.EncodeBinary(f.Msg)
+	} else {
+		data, err = json.Marshal(f.Msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prepared, err := websocket.NewPreparedMessage(msgType, data)
+	if err != nil {
+		return nil, err
+	}
+	f.prepared[encoding] = prepared
+	return prepared, nil
+}
@@ -0,0 +1,403 @@
+/*
+Replay a recorded session to a viewer.
+Messages are sent with the same timing they were recorded with,
+and viewers talk to a replay with the same protocol they use for a live room.
+Viewers can send a TSeek message to jump to any point of the recording
+*/
+package room
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+type Replay struct {
+	lock sync.Mutex
+
+	info message.RoomInfo
+	path string // path to recording file
+
+	// states
+	lastWinsize message.Winsize
+	finished    bool
+
+	// time to jump to (in milliseconds) requested by viewer, holds the latest one
+	seek chan int64
+}
+
+func NewReplay(info message.RoomInfo, path string) *Replay {
+	return &Replay{
+		info: info,
+		path: path,
+		seek: make(chan int64, 1),
+	}
+}
+
+// Total time of the recording in milliseconds
+func RecordDuration(path string) (int64, error) {
+	reader, err := record.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	var duration int64
+	for {
+		msg, err := reader.Next()
+		if err == io.EOF {
+			return duration, nil
+		} else if err != nil {
+			return duration, err
+		}
+		duration = msg.Delay
+	}
+}
+
+// Read through a recording to find when it started and how long it is
+// Fail if the recording is malformed or has nothing to play
+func RecordTimes(path string) (time.Time, int64, error) {
+	reader, err := record.Open(path)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	defer reader.Close()
+
+	var (
+		startTime time.Time
+		duration  int64
+	)
+	for {
+		msg, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return startTime, duration, err
+		}
+
+		if startTime.IsZero() && msg.Type == message.TWriteBlock {
+			block, err := message.ToTermWriteBlock(msg.Data)
+			if err != nil {
+				return startTime, duration, err
+			}
+			startTime = block.StartTime.Add(-time.Duration(msg.Delay) * time.Millisecond)
+		}
+		duration = msg.Delay
+	}
+
+	if startTime.IsZero() {
+		return startTime, duration, fmt.Errorf("Recording is empty")
+	}
+	return startTime, duration, nil
+}
+
+// Serve the recording to a viewer. Blocking until replay is finished or viewer left
+func (rp *Replay) AddViewer(conn *websocket.Conn, encoding message.Encoding) error {
+	reader, err := record.Open(rp.path)
+	if err != nil {
+		log.Printf("Failed to open recording: %s", err)
+		return err
+	}
+
+	// viewers often ask for winsize right after joining
+	rp.lastWinsize = firstWinsize(rp.path)
+
+	cl := NewClient(message.RViewer, conn)
+	cl.SetEncoding(encoding)
+	go cl.Start()
+	go rp.handleClientMessage(cl)
+
+	rp.play(reader, cl)
+	rp.waitRendered(cl)
+	cl.Close()
+	return nil
+}
+
+// Wait until all played messages are sent and rendered by viewer before closing connection
+func (rp *Replay) waitRendered(cl *Client) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for len(cl.Out) > 0 {
+		select {
+		case <-ticker.C:
+		case <-cl.Done():
+			return
+		}
+	}
+
+	select {
+	case <-time.After(time.Duration(rp.info.Delay) * time.Millisecond):
+	case <-cl.Done():
+	}
+}
+
+// Send messages in recording to client following the recorded timing
+func (rp *Replay) play(reader *record.Reader, cl *Client) {
+	startTime := time.Now()
+	defer rp.setFinished()
+	defer func() { reader.Close() }()
+
+	// message that is read but not yet sent
+	var next *message.Wrapper
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		if next == nil {
+			msg, err := reader.Next()
+			if err == io.EOF {
+				log.Printf("Finished replaying room: %d", rp.info.Id)
+				return
+			} else if err != nil {
+				log.Printf("Failed to read recording of room: %d. Error: %s", rp.info.Id, err)
+				return
+			}
+			next = &msg
+		}
+		msg := *next
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(startTime.Add(time.Duration(msg.Delay) * time.Millisecond)))
+
+		select {
+		case <-timer.C:
+			next = nil
+
+		case t := <-rp.seek:
+			reader.Close()
+			var err error
+			reader, next, err = rp.seekTo(t, cl)
+			if err != nil {
+				log.Printf("Failed to seek recording of room: %d. Error: %s", rp.info.Id, err)
+				return
+			}
+			startTime = time.Now().Add(-time.Duration(t) * time.Millisecond)
+			continue
+
+		case <-cl.Done():
+			return
+		}
+
+		switch msg.Type {
+
+		case message.TWriteBlock:
+			payload, err := reviveBlock(msg)
+			if err != nil {
+				log.Printf("Failed to decode recorded block: %s", err)
+				continue
+			}
+			select {
+			case cl.Out <- NewFrame(payload):
+			case <-cl.Done():
+				return
+			}
+
+		case message.TWinsize:
+			winsize := message.Winsize{}
+			if err := message.ToStruct(msg.Data, &winsize); err == nil {
+				rp.lock.Lock()
+				rp.lastWinsize = winsize
+				rp.lock.Unlock()
+			}
+			// viewers get winsize inside blocks in block mode
+			if rp.info.Mode == message.MDirect {
+				select {
+				case cl.Out <- NewFrame(msg):
+				case <-cl.Done():
+					return
+				}
+			}
+
+		case message.TSnapshot:
+			// keyframes are only used for seeking
+
+		case message.TWrite, message.TPause, message.TClose:
+			select {
+			case cl.Out <- NewFrame(msg):
+			case <-cl.Done():
+				return
+			}
+
+		default:
+			log.Printf("Unknown recorded message type: %s", msg.Type)
+		}
+	}
+}
+
+// Rebuild the screen at time t from the closest keyframe and send it to viewer
+// Return a reader positioned right after t and the first message after t if any
+func (rp *Replay) seekTo(t int64, cl *Client) (*record.Reader, *message.Wrapper, error) {
+	keyframe := record.FindKeyframe(rp.path, t)
+	reader, err := record.OpenAt(rp.path, keyframe.Pos)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var next *message.Wrapper
+	emu := emulator.New(int(rp.lastWinsize.Cols), int(rp.lastWinsize.Rows))
+	for {
+		msg, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			reader.Close()
+			return nil, nil, err
+		}
+
+		if msg.Delay > t {
+			next = &msg
+			break
+		}
+
+		if err := emu.WriteMsg(msg); err != nil {
+			log.Printf("Failed to emulate recorded message: %s", err)
+		}
+	}
+
+	snapshot := emu.Snapshot()
+	rp.lock.Lock()
+	rp.lastWinsize = message.Winsize{Rows: snapshot.Rows, Cols: snapshot.Cols}
+	rp.lock.Unlock()
+
+	payload, err := message.SnapshotBlock(snapshot, int64(rp.info.Delay))
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+
+	select {
+	case cl.Out <- NewFrame(payload):
+	case <-cl.Done():
+	}
+	return reader, next, nil
+}
+
+func (rp *Replay) handleClientMessage(cl *Client) {
+	for {
+		var msg message.Wrapper
+		select {
+		case msg = <-cl.In:
+		case <-cl.Done():
+			return
+		}
+
+		switch msgType := msg.Type; msgType {
+
+		case message.TRequestCacheContent:
+			// Nothing has been played yet when viewers join
+
+		case message.TRequestRoomInfo:
+			cl.Send(NewFrame(message.Wrapper{Type: message.TRoomInfo, Data: rp.PrepareRoomInfo()}))
+
+		case message.TRequestCacheChat:
+			cl.Send(NewFrame(message.Wrapper{Type: message.TChat, Data: []message.Chat{}}))
+
+		case message.TRequestWinsize:
+			rp.lock.Lock()
+			winsize := rp.lastWinsize
+			rp.lock.Unlock()
+			cl.Send(NewFrame(message.Wrapper{Type: message.TWinsize, Data: winsize}))
+
+		case message.TChat:
+			// there is no one to chat with in a replay
+
+		case message.TSeek:
+			seek := message.Seek{}
+			if err := message.ToStruct(msg.Data, &seek); err != nil {
+				log.Printf("Failed to decode seek message: %s", err)
+				continue
+			}
+			if seek.Time < 0 {
+				seek.Time = 0
+			}
+
+			// Never wait for playback, which could be finished already
+			// Only the latest seek matters if viewer seeks again before it's handled
+			select {
+			case <-rp.seek:
+			default:
+			}
+			select {
+			case rp.seek <- seek.Time:
+			default:
+			}
+
+		default:
+			log.Printf("Unknown message type :%s", msgType)
+		}
+	}
+}
+
+// Viewers only render a room that is streaming, so a replay reports it's streaming until finished
+func (rp *Replay) PrepareRoomInfo() message.RoomInfo {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	info := rp.info
+	if rp.finished {
+		info.Status = message.RStopped
+	} else {
+		info.Status = message.RStreaming
+	}
+	info.NViewers = 1
+	return info
+}
+
+func (rp *Replay) setFinished() {
+	rp.lock.Lock()
+	rp.finished = true
+	rp.lock.Unlock()
+}
+
+// Viewers schedule messages in a block by comparing the block start time with their current time
+// Pretend recorded block just finished so it's rendered with the same delay it had when streaming
+func reviveBlock(msg message.Wrapper) (message.Wrapper, error) {
+	block, err := message.ToTermWriteBlock(msg.Data)
+	if err != nil {
+		return msg, err
+	}
+	block.StartTime = time.Now().Add(-time.Duration(block.Duration) * time.Millisecond)
+
+	blockByte, err := json.Marshal(block)
+	if err != nil {
+		return msg, err
+	}
+
+	return message.Wrapper{
+		Type: message.TWriteBlock,
+		Data: blockByte,
+	}, nil
+}
+
+func firstWinsize(path string) message.Winsize {
+	winsize := message.Winsize{}
+	reader, err := record.Open(path)
+	if err != nil {
+		return winsize
+	}
+	defer reader.Close()
+
+	for {
+		msg, err := reader.Next()
+		if err != nil {
+			return winsize
+		}
+		if msg.Type == message.TWinsize {
+			message.ToStruct(msg.Data, &winsize)
+			return winsize
+		}
+	}
+}
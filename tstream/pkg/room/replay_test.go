@@ -0,0 +1,37 @@
+package room
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Replies to a viewer too slow to keep up with playback go through its policy instead of blocking
+func TestReplaySlowClient(t *testing.T) {
+	rp := NewReplay(message.RoomInfo{StreamerID: "replay"}, "")
+	cl := slowClient(t, message.PDropOldest)
+	go rp.handleClientMessage(cl)
+	defer cl.Close()
+
+	for _, request := range []message.MType{message.TRequestRoomInfo, message.TRequestCacheChat, message.TRequestWinsize} {
+		cl.In <- message.Wrapper{Type: request}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cl.Dropped() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cl.Dropped() != 3 {
+		t.Fatalf("Dropped %d messages, want 3 for replies", cl.Dropped())
+	}
+
+	var replies []message.MType
+	for len(cl.Out) > 0 {
+		if frame := <-cl.Out; frame.Msg.Seq == 0 {
+			replies = append(replies, frame.Msg.Type)
+		}
+	}
+	if len(replies) != 3 || replies[0] != message.TRoomInfo || replies[1] != message.TChat || replies[2] != message.TWinsize {
+		t.Errorf("Got replies %v, want room info, chat and winsize", replies)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/emulator"
 	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
 	"log"
 	"strings"
 	"sync"
@@ -18,17 +20,33 @@ import (
 var emptyByteArray []byte
 
 type Room struct {
-	lock sync.Mutex
+	lock sync.Mutex // guard states of room, except the ones with their own lock
 
-	streamer *websocket.Conn
-	sfu      *SFU
-	clients  map[string]*Client // Chats + viewrer connection
+	streamer     *websocket.Conn
+	streamerLock sync.Mutex // guard streamer and writes to it
+	sfu          *SFU
+	clients      map[string]*Client // Chats + viewrer connection
 
-	msgBuffer []message.Wrapper
 	cacheChat []message.Chat
 
+	// keep track of the streamer's screen so late joiners can see it right away
+	emulator *emulator.Emulator
+	// recent stream messages for viewers that reconnect
+	buffer *streamBuffer
+	// screen and buffer change together so snapshots are numbered right
+	screenLock sync.Mutex
+	// stream messages, snapshots and viewers joining are queued in order
+	// so viewers never get a message older than one they already have
+	streamLock sync.Mutex
+
+	// persist session for later review
+	recorder    *record.Recorder
+	recordPath  string
+	recordStart time.Time // a room started again keeps the timing of its recording
+
 	// config
 	delay uint64 // Viewer delay time with streamer ( in milliseconds )
+	mode  message.StreamMode
 
 	// states
 	lastWinsize    message.Winsize
@@ -41,6 +59,7 @@ type Room struct {
 	name    string // also is streamerID
 	title   string
 	secret  string // used to verify streamer
+	session string // streaming session of streamer, it stays the same when streamer reconnects
 	status  message.RoomStatus
 	key     string // used to access private room
 	private bool
@@ -48,7 +67,6 @@ type Room struct {
 
 func New(name, title, secret string) *Room {
 	clients := make(map[string]*Client)
-	var buffer []message.Wrapper
 	var cacheChat []message.Chat
 	return &Room{
 		name:           name,
@@ -56,46 +74,79 @@ func New(name, title, secret string) *Room {
 		secret:         secret,
 		clients:        clients,
 		accViewers:     0,
-		msgBuffer:      buffer,
+		emulator:       emulator.New(emulator.DEFAULT_COLS, emulator.DEFAULT_ROWS),
+		buffer:         newStreamBuffer(cfg.ROOM_RESUME_BUFFER),
 		cacheChat:      cacheChat,
 		sfu:            NewSFU(),
 		lastActiveTime: time.Now(),
 		startedTime:    time.Now(),
 		status:         message.RStreaming,
-		// TODO: no more  hardcoding
-		delay: 1500,
+		delay:          cfg.ROOM_DEFAULT_DELAY,
+		mode:           message.MBlock,
 	}
 }
 
 func (r *Room) Private() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.private
 }
 
 func (r *Room) SetPrivate(private bool) {
+	r.lock.Lock()
 	r.private = private
+	r.lock.Unlock()
 }
 
 func (r *Room) Key() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.key
 }
 
 func (r *Room) SetKey(key string) {
+	r.lock.Lock()
 	r.key = key
+	r.lock.Unlock()
 }
 
 func (r *Room) LastActiveTime() time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.lastActiveTime
 }
 
+func (r *Room) touch() {
+	r.lock.Lock()
+	r.lastActiveTime = time.Now()
+	r.lock.Unlock()
+}
+
 func (r *Room) StartedTime() time.Time {
 	return r.startedTime
 }
 
+// A copy of clients, safe to iterate while clients come and go
 func (r *Room) Clients() map[string]*Client {
-	return r.clients
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	clients := make(map[string]*Client, len(r.clients))
+	for id, client := range r.clients {
+		clients[id] = client
+	}
+	return clients
+}
+
+func (r *Room) client(ID string) (*Client, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	client, ok := r.clients[ID]
+	return client, ok
 }
 
 func (r *Room) Id() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.id
 }
 
@@ -105,55 +156,148 @@ func (r *Room) Secret() string {
 
 func (r *Room) NViewers() int {
 	count := 0
-	for _, client := range r.clients {
-		if client.Role() == message.RViewer {
+	for _, client := range r.Clients() {
+		if role := client.Role(); role == message.RViewer || role == message.RCollaborator {
 			count += 1
 		}
 	}
 	return count
 }
 
+func (r *Room) SetSession(session string) {
+	r.lock.Lock()
+	r.session = session
+	r.lock.Unlock()
+}
+
+func (r *Room) Session() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.session
+}
+
 func (r *Room) SetTitle(title string) {
+	r.lock.Lock()
 	r.title = title
+	r.lock.Unlock()
 }
 
 func (r *Room) SetId(id uint64) {
+	r.lock.Lock()
 	r.id = id
+	r.lock.Unlock()
 }
 
 func (r *Room) SetStatus(status message.RoomStatus) {
+	r.lock.Lock()
 	r.status = status
+	r.lock.Unlock()
 }
 
 func (r *Room) Status() message.RoomStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.status
 }
 
+// Delay chosen by streamer, in milliseconds
+func (r *Room) SetDelay(delay uint64) {
+	r.lock.Lock()
+	r.delay = delay
+	r.lock.Unlock()
+}
+
+func (r *Room) Delay() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.delay
+}
+
+func (r *Room) SetMode(mode message.StreamMode) {
+	r.lock.Lock()
+	r.mode = mode
+	r.lock.Unlock()
+}
+
+func (r *Room) Mode() message.StreamMode {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.mode
+}
+
+func (r *Room) Name() string {
+	return r.name
+}
+
 func (r *Room) Title() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.title
 }
 
 func (r *Room) Streamer() *websocket.Conn {
+	r.streamerLock.Lock()
+	defer r.streamerLock.Unlock()
 	return r.streamer
 }
 
+// Set path to record the session to. Leave empty to disable recording
+func (r *Room) SetRecordPath(path string) {
+	r.lock.Lock()
+	r.recordPath = path
+	r.lock.Unlock()
+}
+
+func (r *Room) RecordPath() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.recordPath
+}
+
 // Wait for request from streamer and broadcast those message to clients
 func (r *Room) Start() {
 
+	// Streamer could reconnect and start the room again, keep using the same recording
+	r.lock.Lock()
+	if r.recorder == nil && r.recordPath != "" {
+		recorder, err := record.NewRecorder(r.recordPath)
+		if err != nil {
+			log.Printf("Failed to start recording room: %s. Error: %s", r.name, err)
+		} else {
+			if !r.recordStart.IsZero() {
+				recorder.SetStartTime(r.recordStart)
+			}
+			r.recorder = recorder
+		}
+	}
+	r.lock.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		for _ = range time.Tick(cfg.SERVER_CLEAN_INTERVAL * time.Second) {
-			r.scanAndCleanClients()
+		ticker := time.NewTicker(cfg.SERVER_CLEAN_INTERVAL * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.scanAndCleanClients()
+			case <-done:
+				return
+			}
 		}
 	}()
 
+	// A reconnected streamer replaces this one and closes it, which ends this loop
+	streamer := r.Streamer()
+
 	// Read from streamer and broadcast
 	for {
 		msg := message.Wrapper{}
-		err := r.streamer.ReadJSON(&msg)
+		err := streamer.ReadJSON(&msg)
 
 		if err != nil {
 			log.Printf("Failed to receive message from streamer: %s. Closing. Error: %s", r.name, err)
-			r.streamer.Close()
+			streamer.Close()
 			return
 		}
 
@@ -161,21 +305,45 @@ func (r *Room) Start() {
 
 		case message.TWriteBlock:
 
-			r.addMsgBuffer(msg)
-			r.lastActiveTime = time.Now()
-			r.Broadcast(msg, []message.CRole{message.RViewer}, []string{})
+			r.touch()
+			r.record(msg)
+			r.broadcastStream(msg, []message.CRole{message.RViewer, message.RCollaborator})
 
 		case message.TWinsize:
 			winsize := message.Winsize{}
 			err = message.ToStruct(msg.Data, &winsize)
 
 			if err == nil {
+				r.lock.Lock()
 				r.lastWinsize = winsize
 				r.lastActiveTime = time.Now()
+				r.lock.Unlock()
+				r.record(msg)
+				// viewers get winsize inside blocks in block mode
+				if r.Mode() == message.MDirect {
+					r.broadcastStream(msg, []message.CRole{message.RViewer, message.RCollaborator})
+				} else {
+					r.emulate(msg)
+				}
 			} else {
 				log.Printf("Failed to decode winsize message: %s", err)
 			}
 
+		case message.TWrite, message.TPause:
+			// Streamer in direct mode sends messages one by one
+			r.touch()
+			r.record(msg)
+			r.broadcastStream(msg, []message.CRole{message.RViewer, message.RCollaborator})
+
+		case message.TSnapshot:
+			// Room records its own keyframes
+			r.broadcastStream(msg, []message.CRole{message.RViewer, message.RCollaborator})
+
+		case message.TClose:
+			// Program of streamer exited, streamer closes the connection right after
+			r.record(msg)
+			r.broadcastStream(msg, []message.CRole{message.RViewer, message.RCollaborator, message.RStreamerChat})
+
 		default:
 			log.Printf("Unknown message type: %s", msgType)
 		}
@@ -183,23 +351,22 @@ func (r *Room) Start() {
 }
 
 func (r *Room) AddStreamer(conn *websocket.Conn) error {
+	log.Printf("New streamer")
+	r.streamerLock.Lock()
 	if r.streamer != nil {
 		r.streamer.Close()
 	}
-	// Verify streamer secret
-
-	log.Printf("New streamer")
 	r.streamer = conn
-	r.status = message.RStreaming
+	r.streamerLock.Unlock()
+	r.SetStatus(message.RStreaming)
 
 	conn.SetPongHandler(func(appData string) error {
-		r.lastActiveTime = time.Now()
+		r.touch()
 		return nil
 	})
 
-	r.streamer.SetCloseHandler(func(code int, text string) error {
+	conn.SetCloseHandler(func(code int, text string) error {
 		log.Printf("Got streamer close message. Stopping room: %s", r.name)
-		r.status = message.RStopped
 		r.Stop(message.RStopped)
 		return nil
 	})
@@ -208,39 +375,59 @@ func (r *Room) AddStreamer(conn *websocket.Conn) error {
 	// If streamer response with a pong message => still alive
 	go func() {
 		for _ = range time.Tick(cfg.SERVER_PING_INTERVAL * time.Second) {
-			if r.status == message.RStopped {
+			// a reconnected streamer has its own pings
+			if r.Status() == message.RStopped || r.Streamer() != conn {
 				return
 			}
-			if time.Now().Sub(r.lastActiveTime) > time.Second*cfg.SERVER_DISCONNECTED_THRESHHOLD {
-				r.status = message.RStopped
+			if time.Since(r.LastActiveTime()) > time.Second*cfg.SERVER_DISCONNECTED_THRESHHOLD {
+				r.SetStatus(message.RStopped)
 			} else {
-				r.status = message.RStreaming
+				r.SetStatus(message.RStreaming)
 			}
-			r.streamer.WriteControl(websocket.PingMessage, emptyByteArray, time.Time{})
+			conn.WriteControl(websocket.PingMessage, emptyByteArray, time.Time{})
 		}
 	}()
 
 	return nil
 }
 
-func (r *Room) AddClient(ID string, role message.CRole, conn *websocket.Conn) error {
-	_, ok := r.clients[ID]
-	if ok {
-		return fmt.Errorf("Room :%s, Client %s existed", r.Id, ID)
+func (r *Room) AddClient(ID string, info message.ClientInfo, conn *websocket.Conn) error {
+	if _, ok := r.client(ID); ok {
+		return fmt.Errorf("Room :%d, Client %s existed", r.Id(), ID)
 	}
 
+	name, role := info.Name, info.Role
 	cl := NewClient(role, conn)
+	cl.SetEncoding(info.Encoding)
+	cl.SetSnapshot(r.snapshot)
 	switch role {
 
 	case message.RViewer:
+		policy := info.Policy
+		if policy == "" {
+			policy = cfg.ROOM_VIEWER_POLICY
+		}
+		cl.SetPolicy(policy)
+		// viewers that reconnect get the messages they missed before any new one
+		r.streamLock.Lock()
+		r.lock.Lock()
+		cl.SetName(r.uniqueName(name, role))
 		r.accViewers += 1
 		r.clients[ID] = cl
+		r.lock.Unlock()
+		if info.LastSeq > 0 {
+			r.resume(cl, info.LastSeq)
+		}
+		r.streamLock.Unlock()
 		go cl.Start()
 		r.ReadAndHandleClientMessage(ID) // Blocking call
 		return nil
 
 	case message.RStreamerChat:
+		r.lock.Lock()
+		cl.SetName(r.uniqueName(name, role))
 		r.clients[ID] = cl
+		r.lock.Unlock()
 		go cl.Start()
 		r.ReadAndHandleClientMessage(ID) // Blocking call
 		return nil
@@ -258,47 +445,122 @@ func (r *Room) AddClient(ID string, role message.CRole, conn *websocket.Conn) er
 	return nil
 }
 
-func (r *Room) RemoveClient(ID string) error {
-	_, ok := r.clients[ID]
+// Add a viewer that lives in server process, like viewers connected via SSH
+// Caller reads messages for viewer from Out, writes requests to In and closes client when finished
+func (r *Room) AddLocalClient(role message.CRole) (string, *Client, error) {
+	if role != message.RViewer {
+		return "", nil, fmt.Errorf("Invalid local client role: %s", role)
+	}
+
+	ID := r.NewClientID()
+	cl := NewClient(role, nil)
+	cl.SetSnapshot(r.snapshot)
+	cl.SetPolicy(cfg.ROOM_VIEWER_POLICY)
+	r.lock.Lock()
+	r.accViewers += 1
+	r.clients[ID] = cl
+	r.lock.Unlock()
+
+	go func() {
+		r.ReadAndHandleClientMessage(ID) // Blocking call
+		r.RemoveClient(ID)
+	}()
+	return ID, cl, nil
+}
+
+// Chat names are unique in room, a taken name gets a number appended
+// Viewers can't take the name of streamer. Caller holds r.lock
+func (r *Room) uniqueName(name string, role message.CRole) string {
+	if name == "" {
+		return ""
+	}
+
+	taken := func(name string) bool {
+		if role != message.RStreamerChat && name == r.name {
+			return true
+		}
+		for _, client := range r.clients {
+			if client.Name() == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	unique := name
+	for i := 2; taken(unique); i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+// Name of client is fixed once it's known, clients that join without one take it on their first chat
+func (r *Room) claimName(ID, name string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	client, ok := r.clients[ID]
 	if !ok {
-		return fmt.Errorf("CLient %s not found", ID)
+		return name
 	}
+	if current := client.Name(); current != "" {
+		return current
+	}
+	unique := r.uniqueName(name, client.Role())
+	client.SetName(unique)
+	return unique
+}
 
+func (r *Room) RemoveClient(ID string) error {
 	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.clients[ID]; !ok {
+		return fmt.Errorf("CLient %s not found", ID)
+	}
 	delete(r.clients, ID)
-	r.lock.Unlock()
 	return nil
 }
 
-func (r *Room) addMsgBuffer(msg message.Wrapper) {
-	if len(r.msgBuffer) > cfg.ROOM_BUFFER_SIZE {
-		r.msgBuffer = r.msgBuffer[1:]
+func (r *Room) emulate(msg message.Wrapper) {
+	if err := r.emulator.WriteMsg(msg); err != nil {
+		log.Printf("Failed to emulate message of room: %s. Error: %s", r.name, err)
 	}
-	r.msgBuffer = append(r.msgBuffer, msg)
 }
 
 func (r *Room) addCacheChat(chat message.Chat) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if len(r.cacheChat) >= cfg.ROOM_CACHE_MSG_SIZE {
 		r.cacheChat = r.cacheChat[1:]
 	}
 	r.cacheChat = append(r.cacheChat, chat)
 }
 
+func (r *Room) CacheChat() []message.Chat {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]message.Chat{}, r.cacheChat...)
+}
+
 func (r *Room) ReadAndHandleClientMessage(ID string) {
-	client, ok := r.clients[ID]
+	client, ok := r.client(ID)
 	if !ok {
 		return
 	}
 	for {
-		msg, _ := <-client.In
+		var msg message.Wrapper
+		select {
+		case msg = <-client.In:
+		case <-client.Done():
+			return
+		}
 
 		switch msgType := msg.Type; msgType {
 
 		case message.TRequestCacheContent:
-			// Send msg buffer so clients doesn't face a idle screen when first started
-			for _, msg := range r.msgBuffer {
-				client.Out <- msg
-			}
+			// Send the current screen so clients doesn't face a idle screen when first started
+			r.streamLock.Lock()
+			r.sendSnapshot(client)
+			r.streamLock.Unlock()
 
 		case message.TRequestRoomInfo:
 
@@ -308,15 +570,16 @@ func (r *Room) ReadAndHandleClientMessage(ID string) {
 				Data: roomInfo,
 			}
 
-			client.Out <- payload
+			client.Send(NewFrame(payload))
 
 		case message.TRequestCacheChat:
 
-			payload := message.Wrapper{Type: message.TChat, Data: r.cacheChat}
-			client.Out <- payload
+			payload := message.Wrapper{Type: message.TChat, Data: r.CacheChat()}
+			client.Send(NewFrame(payload))
 
 		case message.TRequestWinsize:
 
+			r.lock.Lock()
 			payload := message.Wrapper{
 				Type: message.TWinsize,
 				Data: message.Winsize{
@@ -324,7 +587,8 @@ func (r *Room) ReadAndHandleClientMessage(ID string) {
 					Cols: r.lastWinsize.Cols,
 				},
 			}
-			client.Out <- payload
+			r.lock.Unlock()
+			client.Send(NewFrame(payload))
 
 		case message.TChat:
 			var chatList []message.Chat
@@ -341,13 +605,46 @@ func (r *Room) ReadAndHandleClientMessage(ID string) {
 				log.Printf("Error: %s", err)
 			}
 
-			for _, chat := range toAddChatList {
-				r.addCacheChat(chat)
+			for i, chat := range toAddChatList {
+				// chats are sent with the name of sender, whatever it claims to be
+				name := r.claimName(ID, chat.Name)
+				if name != chat.Name && chat.Name != "" && i == 0 {
+					client.Send(NewFrame(message.Wrapper{Type: message.TChat, Data: []message.Chat{{
+						Content: fmt.Sprintf("Your name in this room is %s", name),
+						Time:    time.Now().Format(time.RFC3339),
+					}}}))
+				}
+				toAddChatList[i].Name = name
+				toAddChatList[i].ID = ID
+				r.addCacheChat(toAddChatList[i])
 			}
 
 			if len(toAddChatList) > 0 {
 				payload := message.Wrapper{Type: message.TChat, Data: toAddChatList}
-				r.Broadcast(payload, []message.CRole{message.RViewer, message.RStreamerChat}, []string{ID})
+				r.Broadcast(payload, []message.CRole{message.RViewer, message.RCollaborator, message.RStreamerChat}, []string{ID})
+			}
+
+		case message.TControl:
+			if client.Role() != message.RStreamerChat {
+				log.Printf("Unauthorized set control")
+				continue
+			}
+
+			control := message.Control{}
+			if err := message.ToStruct(msg.Data, &control); err != nil {
+				log.Printf("Failed to decode control: %s", err)
+				continue
+			}
+			r.setControl(control)
+
+		case message.TInput:
+			if client.Role() != message.RCollaborator {
+				log.Printf("Unauthorized input from client: %s", ID)
+				continue
+			}
+
+			if err := r.writeStreamer(msg); err != nil {
+				log.Printf("Failed to forward input to streamer: %s", err)
 			}
 		case message.TRoomUpdate:
 			if client.Role() != message.RStreamerChat && client.Role() != message.RStreamer {
@@ -362,7 +659,7 @@ func (r *Room) ReadAndHandleClientMessage(ID string) {
 				log.Printf("Failed to decode roominfo: %s", err)
 				continue
 			} else {
-				r.title = newRoomInfo.Title
+				r.SetTitle(newRoomInfo.Title)
 				roomInfo := r.PrepareRoomInfo()
 				payload := message.Wrapper{
 					Type: message.TRoomInfo,
@@ -370,7 +667,7 @@ func (r *Room) ReadAndHandleClientMessage(ID string) {
 				}
 				// Broadcast to all participants
 				r.Broadcast(payload,
-					[]message.CRole{message.RStreamer, message.RStreamerChat, message.RViewer},
+					[]message.CRole{message.RStreamer, message.RStreamerChat, message.RViewer, message.RCollaborator},
 					[]string{})
 			}
 
@@ -381,10 +678,60 @@ func (r *Room) ReadAndHandleClientMessage(ID string) {
 	}
 }
 
+// Grant or revoke control of streamer's shell to the viewer with control.ID
+func (r *Room) setControl(control message.Control) {
+	role := message.RViewer
+	if control.Granted {
+		role = message.RCollaborator
+	}
+
+	for ID, client := range r.Clients() {
+		current := client.Role()
+		if current == role || (current != message.RViewer && current != message.RCollaborator) {
+			continue
+		}
+		// Only revoking can be done to everyone at once
+		if ID != control.ID && (control.Granted || control.ID != "") {
+			continue
+		}
+
+		client.SetRole(role)
+		client.Send(NewFrame(message.Wrapper{Type: message.TControl, Data: message.Control{Name: client.Name(), Granted: control.Granted}}))
+	}
+
+	payload := message.Wrapper{Type: message.TRoomInfo, Data: r.PrepareRoomInfo()}
+	r.Broadcast(payload,
+		[]message.CRole{message.RStreamerChat, message.RViewer, message.RCollaborator},
+		[]string{})
+}
+
+func (r *Room) collaborators() []string {
+	var names []string
+	for _, client := range r.Clients() {
+		if client.Role() == message.RCollaborator {
+			names = append(names, client.Name())
+		}
+	}
+	return names
+}
+
+// Gorilla websocket supports one concurrent writer, pings are the only other writes to streamer
+func (r *Room) writeStreamer(msg message.Wrapper) error {
+	r.streamerLock.Lock()
+	defer r.streamerLock.Unlock()
+	if r.streamer == nil {
+		return fmt.Errorf("Room %s has no streamer", r.name)
+	}
+	return r.streamer.WriteJSON(msg)
+}
+
 func (r *Room) Broadcast(msg message.Wrapper, roles []message.CRole, IDExclude []string) {
+	r.broadcastFrame(NewFrame(msg), roles, IDExclude)
+}
 
-	// TODO : make this run concurrently
-	for id, client := range r.clients {
+// Send the same frame to clients so it's only encoded once
+func (r *Room) broadcastFrame(frame *Frame, roles []message.CRole, IDExclude []string) {
+	for id, client := range r.Clients() {
 		// Check if client is in the list of roles to broadcast
 		found := false
 		for _, role := range roles {
@@ -408,7 +755,7 @@ func (r *Room) Broadcast(msg message.Wrapper, roles []message.CRole, IDExclude [
 		}
 
 		if client.Alive() {
-			client.Out <- msg
+			client.Send(frame)
 		} else {
 			log.Printf("Failed to boardcast to %s. Closing connection", id)
 			r.RemoveClient(id)
@@ -416,22 +763,101 @@ func (r *Room) Broadcast(msg message.Wrapper, roles []message.CRole, IDExclude [
 	}
 }
 
+// Broadcast a message of streamer's terminal
+// It's numbered and kept so viewers can resume from it
+func (r *Room) broadcastStream(msg message.Wrapper, roles []message.CRole) {
+	r.streamLock.Lock()
+	defer r.streamLock.Unlock()
+
+	r.screenLock.Lock()
+	r.emulate(msg)
+	frame := r.buffer.Add(msg)
+	r.screenLock.Unlock()
+	r.broadcastFrame(frame, roles, []string{})
+}
+
+// Queue the stream messages after lastSeq. Caller holds r.streamLock
+func (r *Room) resume(client *Client, lastSeq uint64) {
+	frames, ok := r.buffer.Since(lastSeq)
+	if !ok {
+		// Missed too much, start over from the current screen
+		r.sendSnapshot(client)
+		return
+	}
+	for _, frame := range frames {
+		client.Send(frame)
+	}
+}
+
+// The current screen, numbered with the last stream message it includes
+func (r *Room) snapshot() (*Frame, error) {
+	r.screenLock.Lock()
+	snapshot, seq := r.emulator.Snapshot(), r.buffer.Seq()
+	r.screenLock.Unlock()
+
+	payload, err := message.SnapshotBlock(snapshot, int64(r.Delay()))
+	if err != nil {
+		return nil, err
+	}
+	payload.Seq = seq
+	return NewFrame(payload), nil
+}
+
+func (r *Room) sendSnapshot(client *Client) {
+	frame, err := r.snapshot()
+	if err != nil {
+		log.Printf("Failed to create snapshot of room: %s. Error: %s", r.name, err)
+		return
+	}
+	client.Send(frame)
+}
+
 func (r *Room) Stop(status message.RoomStatus) {
 	log.Printf("Stopping room: %s, with Status: %s", r.name, status)
-	r.status = status
-	for id, client := range r.clients {
+	r.SetStatus(status)
+	for id, client := range r.Clients() {
 		client.Close()
 		r.RemoveClient(id)
 	}
 	r.sfu.Stop()
-	r.streamer.Close()
+	if streamer := r.Streamer(); streamer != nil {
+		streamer.Close()
+	}
+
+	r.lock.Lock()
+	if r.recorder != nil {
+		if err := r.recorder.Close(); err != nil {
+			log.Printf("Failed to close recording of room: %s. Error: %s", r.name, err)
+		}
+		// a restarted room opens the recording again
+		r.recordStart = r.recorder.StartTime()
+		r.recorder = nil
+	}
+	r.lock.Unlock()
+}
+
+func (r *Room) record(msg message.Wrapper) {
+	r.lock.Lock()
+	recorder := r.recorder
+	r.lock.Unlock()
+	if recorder == nil {
+		return
+	}
+	if err := recorder.WriteMsg(msg); err != nil {
+		log.Printf("Failed to record message of room: %s. Error: %s", r.name, err)
+	}
 }
 
 func (r *Room) PrepareRoomInfo() message.RoomInfo {
+	// both go through clients, which needs the lock
+	nViewers, collaborators := r.NViewers(), r.collaborators()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return message.RoomInfo{
 		Id:             r.id,
 		Title:          r.title,
-		NViewers:       r.NViewers(),
+		NViewers:       nViewers,
 		StartedTime:    r.startedTime,
 		LastActiveTime: r.lastActiveTime,
 		StreamerID:     r.name,
@@ -439,12 +865,14 @@ func (r *Room) PrepareRoomInfo() message.RoomInfo {
 		AccNViewers:    r.accViewers,
 		Delay:          r.delay,
 		Private:        r.private,
+		Collaborators:  collaborators,
+		Mode:           r.mode,
 	}
 }
 
 func (r *Room) NewClientID() string {
 	newID := uuid.New().String()
-	if _, ok := r.clients[newID]; ok {
+	if _, ok := r.client(newID); ok {
 		return r.NewClientID()
 	} else {
 		return newID
@@ -453,17 +881,28 @@ func (r *Room) NewClientID() string {
 
 func (r *Room) Summary() map[string]interface{} {
 	summary := make(map[string]interface{})
-	summary["StreamerStatus"] = r.status
+	summary["StreamerStatus"] = r.Status()
 	summary["NViewers"] = r.NViewers()
-	summary["NClients"] = len(r.clients)
-	summary["sfu.Nparticipants"] = len(r.sfu.participants)
-	summary["sfu.Nlocaltracks"] = len(r.sfu.trackLocals)
+	summary["NClients"] = len(r.Clients())
+	summary["DroppedMessages"] = r.droppedMessages()
+	summary["sfu.Nparticipants"], summary["sfu.Nlocaltracks"] = r.sfu.Size()
 	return summary
 }
 
+// Number of messages dropped for each client that was too slow
+func (r *Room) droppedMessages() map[string]uint64 {
+	dropped := make(map[string]uint64)
+	for id, client := range r.Clients() {
+		if n := client.Dropped(); n > 0 {
+			dropped[id] = n
+		}
+	}
+	return dropped
+}
+
 // Clean in active rooms or stopped one
 func (r *Room) scanAndCleanClients() {
-	for id, cl := range r.clients {
+	for id, cl := range r.Clients() {
 		if !cl.Alive() {
 			r.RemoveClient(id)
 		}
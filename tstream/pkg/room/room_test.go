@@ -0,0 +1,433 @@
+package room
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+)
+
+// Run with -race, local viewers come and go while the room broadcasts and reports its state
+func TestRaceLocalClients(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("race", "race", "secret")
+
+	controlled, _, err := room.AddLocalClient(message.RViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, cl, err := room.AddLocalClient(message.RViewer)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				cl.In <- message.Wrapper{Type: message.TChat, Data: []message.Chat{{Name: fmt.Sprintf("viewer-%d", i), Content: "hi"}}}
+				cl.In <- message.Wrapper{Type: message.TRequestRoomInfo}
+				cl.In <- message.Wrapper{Type: message.TRequestCacheChat}
+				cl.Close()
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			room.broadcastStream(message.Wrapper{Type: message.TWrite, Data: []byte("hi\r\n")}, []message.CRole{message.RViewer, message.RCollaborator})
+			room.setControl(message.Control{ID: controlled, Granted: i%2 == 0})
+			room.SetTitle(fmt.Sprint(i))
+			room.PrepareRoomInfo()
+			room.Summary()
+			room.scanAndCleanClients()
+		}
+	}()
+	wg.Wait()
+
+	// clients are removed once they stop reading messages
+	deadline := time.Now().Add(5 * time.Second)
+	for room.NViewers() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := room.PrepareRoomInfo()
+	if info.NViewers != 1 || info.AccNViewers != 201 || info.Title != "99" {
+		t.Errorf("Room has %d viewers of %d and title %s, want 1 of 201 and 99", info.NViewers, info.AccNViewers, info.Title)
+	}
+	if seq := room.buffer.Seq(); seq != 100 {
+		t.Errorf("Room broadcast %d stream messages, want 100", seq)
+	}
+	if _, ok := room.client(controlled); !ok {
+		t.Error("Controlled viewer is gone")
+	}
+}
+
+// Read what client is sent until a message of msgType
+func waitFor(t *testing.T, cl *Client, msgType message.MType) message.Wrapper {
+	t.Helper()
+	for {
+		select {
+		case frame := <-cl.Out:
+			if frame.Msg.Type == msgType {
+				return frame.Msg
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", msgType)
+		}
+	}
+}
+
+func chatAs(cl *Client, name string) {
+	cl.In <- message.Wrapper{Type: message.TChat, Data: []message.Chat{{Name: name, Content: "hi"}}}
+}
+
+func receivedChat(t *testing.T, cl *Client) message.Chat {
+	t.Helper()
+	var chats []message.Chat
+	if err := message.ToStruct(waitFor(t, cl, message.TChat).Data, &chats); err != nil || len(chats) != 1 {
+		t.Fatalf("Failed to decode chat: %v, %s", chats, err)
+	}
+	return chats[0]
+}
+
+func TestChatNames(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("streamer", "title", "secret")
+	aliceID, alice, _ := room.AddLocalClient(message.RViewer)
+	otherID, other, _ := room.AddLocalClient(message.RViewer)
+	defer alice.Close()
+	defer other.Close()
+
+	chatAs(alice, "alice")
+	if chat := receivedChat(t, other); chat.Name != "alice" || chat.ID != aliceID {
+		t.Errorf("Got chat from %s (%s), want alice (%s)", chat.Name, chat.ID, aliceID)
+	}
+
+	// name is taken, other is told the name it got
+	chatAs(other, "alice")
+	if chat := receivedChat(t, other); chat.Name != "" || chat.Content != "Your name in this room is alice-2" {
+		t.Errorf("Got notification %q from %q", chat.Content, chat.Name)
+	}
+	if chat := receivedChat(t, alice); chat.Name != "alice-2" || chat.ID != otherID {
+		t.Errorf("Got chat from %s (%s), want alice-2 (%s)", chat.Name, chat.ID, otherID)
+	}
+
+	// names are fixed after the first chat
+	chatAs(alice, "bob")
+	if chat := receivedChat(t, alice); chat.Content != "Your name in this room is alice" {
+		t.Errorf("Got notification %q", chat.Content)
+	}
+	if chat := receivedChat(t, other); chat.Name != "alice" {
+		t.Errorf("Got chat from %s, want alice", chat.Name)
+	}
+
+	// nobody chats as streamer
+	_, impostor, _ := room.AddLocalClient(message.RViewer)
+	defer impostor.Close()
+	chatAs(impostor, "streamer")
+	if chat := receivedChat(t, alice); chat.Name != "streamer-2" {
+		t.Errorf("Got chat from %s, want streamer-2", chat.Name)
+	}
+}
+
+func TestControl(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("streamer", "title", "secret")
+	aliceID, alice, _ := room.AddLocalClient(message.RViewer)
+	_, other, _ := room.AddLocalClient(message.RViewer)
+	defer alice.Close()
+	defer other.Close()
+
+	chatAs(alice, "alice")
+	chatAs(other, "bob")
+	receivedChat(t, alice)
+	receivedChat(t, other)
+
+	// only IDs pick who gets control
+	room.setControl(message.Control{Name: "bob", Granted: true})
+	room.setControl(message.Control{ID: aliceID, Granted: true})
+	control := message.Control{}
+	if err := message.ToStruct(waitFor(t, alice, message.TControl).Data, &control); err != nil || !control.Granted || control.Name != "alice" {
+		t.Errorf("Got control %v, want alice granted", control)
+	}
+	if alice.Role() != message.RCollaborator || other.Role() != message.RViewer {
+		t.Errorf("Roles are %s and %s, want only alice to have control", alice.Role(), other.Role())
+	}
+	if collaborators := room.PrepareRoomInfo().Collaborators; len(collaborators) != 1 || collaborators[0] != "alice" {
+		t.Errorf("Collaborators are %v, want alice", collaborators)
+	}
+
+	room.setControl(message.Control{Granted: false})
+	if alice.Role() != message.RViewer {
+		t.Errorf("Role is %s after revoking everyone", alice.Role())
+	}
+}
+
+// Two ends of a real websocket, the one server accepted and the one dialed
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return <-conns, conn
+}
+
+// Connect a streamer to room through a real websocket, return the streamer side
+func connectStreamer(t *testing.T, room *Room) *websocket.Conn {
+	t.Helper()
+	accepted, conn := wsPair(t)
+	room.AddStreamer(accepted)
+	return conn
+}
+
+// Stream one block and wait until room has taken it
+func streamBlock(t *testing.T, room *Room, conn *websocket.Conn) {
+	t.Helper()
+	data, _ := json.Marshal(message.Wrapper{Type: message.TWrite, Data: []byte("hi\r\n")})
+	block, err := message.EncodeBlock([][]byte{data}, time.Now(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := room.buffer.Seq()
+	if err := conn.WriteJSON(block); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for room.buffer.Seq() == seq && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A stopped room that streamer starts again keeps recording into the same file
+func TestRestartRecording(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("record", "record", "secret")
+	path := filepath.Join(t.TempDir(), "record.gz")
+	room.SetRecordPath(path)
+
+	for i := 0; i < 2; i++ {
+		conn := connectStreamer(t, room)
+		done := make(chan struct{})
+		go func() {
+			room.Start()
+			close(done)
+		}()
+		streamBlock(t, room, conn)
+		room.Stop(message.RStopped)
+		<-done
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	reader, err := record.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	blocks, delay := 0, int64(0)
+	for {
+		msg, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == message.TWriteBlock {
+			blocks++
+		}
+		if msg.Delay < delay {
+			t.Errorf("Recording goes back from %dms to %dms", delay, msg.Delay)
+		}
+		delay = msg.Delay
+	}
+	if blocks != 2 || delay < 50 {
+		t.Errorf("Recorded %d blocks ending at %dms, want 2 ending after the pause", blocks, delay)
+	}
+}
+
+// Stopping a room doesn't wait for its clients one by one
+func TestStopClients(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("stop", "stop", "secret")
+
+	var viewers []*websocket.Conn
+	for i := 0; i < 5; i++ {
+		accepted, viewer := wsPair(t)
+		go room.AddClient(fmt.Sprint(i), message.ClientInfo{Role: message.RViewer}, accepted)
+		viewers = append(viewers, viewer)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for room.NViewers() != 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	room.Stop(message.RStopped)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stopping took %s, want clients closed in background", elapsed)
+	}
+
+	// every viewer is still told the room is closed
+	for i, viewer := range viewers {
+		viewer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := viewer.ReadMessage()
+			if websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+				break
+			} else if err != nil {
+				t.Errorf("Viewer %d got %s, want a close message", i, err)
+				break
+			}
+		}
+	}
+}
+
+// Snapshots of streamer reach viewers as stream messages, recordings have keyframes of their own instead
+func TestStreamerSnapshot(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("snapshot", "snapshot", "secret")
+	path := filepath.Join(t.TempDir(), "record.gz")
+	room.SetRecordPath(path)
+	_, viewer, err := room.AddLocalClient(message.RViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectStreamer(t, room)
+	done := make(chan struct{})
+	go func() {
+		room.Start()
+		close(done)
+	}()
+	snapshot := message.Snapshot{Rows: 24, Cols: 80, Data: []byte("screen")}
+	if err := conn.WriteJSON(message.Wrapper{Type: message.TSnapshot, Data: snapshot}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := waitFor(t, viewer, message.TSnapshot)
+	got := message.Snapshot{}
+	if err := message.ToStruct(msg.Data, &got); err != nil || msg.Seq != 1 || string(got.Data) != "screen" {
+		t.Errorf("Got snapshot %q with seq %d: %v, want the one of streamer", got.Data, msg.Seq, err)
+	}
+	room.Stop(message.RStopped)
+	<-done
+
+	reader, err := record.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if msg, err := reader.Next(); err != io.EOF {
+		t.Errorf("Recorded %s: %v, want nothing", msg.Type, err)
+	}
+}
+
+// Exit code of the program streamed is sent to viewers and kept in recording
+func TestStreamerClose(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("close", "close", "secret")
+	path := filepath.Join(t.TempDir(), "record.gz")
+	room.SetRecordPath(path)
+	_, viewer, err := room.AddLocalClient(message.RViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectStreamer(t, room)
+	done := make(chan struct{})
+	go func() {
+		room.Start()
+		close(done)
+	}()
+	if err := conn.WriteJSON(message.Wrapper{Type: message.TClose, Data: message.Close{Command: "make test", ExitCode: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := message.Close{}
+	if err := message.ToStruct(waitFor(t, viewer, message.TClose).Data, &got); err != nil || got.Command != "make test" || got.ExitCode != 2 {
+		t.Errorf("Got %q exited with %d: %v, want make test with code 2", got.Command, got.ExitCode, err)
+	}
+	room.Stop(message.RStopped)
+	<-done
+
+	reader, err := record.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if msg, err := reader.Next(); err != nil || msg.Type != message.TClose {
+		t.Errorf("Recorded %s: %v, want the close message", msg.Type, err)
+	}
+}
+
+// Room in direct mode passes every message of streamer on to viewers as it comes
+func TestDirectStream(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	room := New("direct", "direct", "secret")
+	room.SetMode(message.MDirect)
+	_, viewer, err := room.AddLocalClient(message.RViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectStreamer(t, room)
+	done := make(chan struct{})
+	go func() {
+		room.Start()
+		close(done)
+	}()
+	defer func() {
+		room.Stop(message.RStopped)
+		<-done
+	}()
+	if err := conn.WriteJSON(message.Wrapper{Type: message.TWinsize, Data: message.Winsize{Rows: 30, Cols: 100}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(message.Wrapper{Type: message.TWrite, Data: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// viewers get winsize on its own instead of inside blocks
+	winsizeMsg := waitFor(t, viewer, message.TWinsize)
+	winsize := message.Winsize{}
+	if err := message.ToStruct(winsizeMsg.Data, &winsize); err != nil || winsize.Rows != 30 || winsize.Cols != 100 {
+		t.Errorf("Got winsize %dx%d: %v, want 100x30", winsize.Cols, winsize.Rows, err)
+	}
+	writeMsg := waitFor(t, viewer, message.TWrite)
+	var data []byte
+	if err := message.ToStruct(writeMsg.Data, &data); err != nil || string(data) != "hi" {
+		t.Errorf("Got write %q: %v, want hi", data, err)
+	}
+	if writeMsg.Seq <= winsizeMsg.Seq {
+		t.Errorf("Got write with seq %d after winsize with seq %d, want it to follow", writeMsg.Seq, winsizeMsg.Seq)
+	}
+}
@@ -90,7 +90,7 @@ func (s *SFU) AddPeer(cl *Client) error {
 				Data:  string(candidate),
 			}}
 
-		cl.Out <- payload
+		cl.Out <- NewFrame(payload)
 	})
 
 	peerConn.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
@@ -323,22 +323,27 @@ func (s *SFU) removeLocalTrack(id string) {
 func (s *SFU) newParticipantID() string {
 	for {
 		id := uuid.New().String()
-		if _, ok := s.participants[id]; !ok {
+		s.lock.RLock()
+		_, ok := s.participants[id]
+		s.lock.RUnlock()
+		if !ok {
 			return id
 		}
 	}
 }
 
 func (s *SFU) removeParticipant(id string) {
-	if _, ok := s.participants[id]; !ok {
+	s.lock.RLock()
+	participant, ok := s.participants[id]
+	s.lock.RUnlock()
+	if !ok {
 		return
 	}
-	participant := s.participants[id]
 	role := participant.client.Role()
 
 	// receiver in this context is the track producer send to server
 	// if pariticipant is a producer => remove their track
-	for _, receiver := range s.participants[id].peer.GetReceivers() {
+	for _, receiver := range participant.peer.GetReceivers() {
 		if receiver.Track() == nil {
 			continue
 		}
@@ -380,17 +385,31 @@ func (s *SFU) sendOffer(participant *Participant) error {
 			Data:  string(offerByte),
 		},
 	}
-	participant.client.Out <- payload
+	participant.client.Out <- NewFrame(payload)
 	return nil
 }
 
 func (s *SFU) Stop() {
 	log.Printf("Stopping SFU")
-	for id, _ := range s.participants {
+	s.lock.RLock()
+	var ids []string
+	for id := range s.participants {
+		ids = append(ids, id)
+	}
+	s.lock.RUnlock()
+
+	for _, id := range ids {
 		s.removeParticipant(id)
 	}
 }
 
+// Number of participants and local tracks
+func (s *SFU) Size() (int, int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.participants), len(s.trackLocals)
+}
+
 // used for video broadcasting
 // without sending keyframe user will receive a crappy video until the next keyframe is sent
 func (s *SFU) sendKeyFrame() {
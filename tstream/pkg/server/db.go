@@ -1,16 +1,19 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/qnkhuat/tstream/pkg/message"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
 	// Bucket names
-	BROOMS string = "ROOMS"
+	BROOMS  string = "ROOMS"
+	BOWNERS string = "OWNERS"
 )
 
 type DB struct {
@@ -32,6 +35,12 @@ func SetupDB(path string) (*DB, error) {
 		if err != nil {
 			return fmt.Errorf("could not create root bucket: %v", err)
 		}
+
+		// Secret of who owns each streamer ID
+		_, err = tx.CreateBucketIfNotExists([]byte(BOWNERS))
+		if err != nil {
+			return fmt.Errorf("could not create owners bucket: %v", err)
+		}
 		return nil
 	})
 
@@ -102,6 +111,40 @@ func (db *DB) AddRoom(obj message.RoomInfo) (uint64, error) {
 	return id, err
 }
 
+/*
+- OWNERS
+  - STREAMERID: sha256 of SECRET
+The first secret a streamer ID is used with owns it
+*/
+func (db *DB) Authorize(streamerID, secret string) (bool, error) {
+	hash := sha256.Sum256([]byte(secret))
+	authorized := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOWNERS))
+		owner := b.Get([]byte(streamerID))
+		if owner == nil {
+			authorized = true
+			return b.Put([]byte(streamerID), hash[:])
+		}
+		authorized = subtle.ConstantTimeCompare(owner, hash[:]) == 1
+		return nil
+	})
+	return authorized, err
+}
+
+func (db *DB) GetRoom(id uint64) (message.RoomInfo, error) {
+	room := message.RoomInfo{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BROOMS))
+		v := b.Get(itob(id))
+		if v == nil {
+			return fmt.Errorf("Room %d not found", id)
+		}
+		return json.Unmarshal(v, &room)
+	})
+	return room, err
+}
+
 // skip: number of records to skip
 // n : number of records toget. Set to 0 to get all
 // private : set to true to return private room. Default is not return Private room
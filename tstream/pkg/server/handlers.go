@@ -3,8 +3,11 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -14,6 +17,8 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/qnkhuat/tstream/internal/cfg"
 	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+	"github.com/qnkhuat/tstream/pkg/room"
 )
 
 // upgrade an http request to websocket
@@ -76,10 +81,40 @@ func (s *Server) handleListRooms(w http.ResponseWriter, r *http.Request) {
 
 /*** Add room API ***/
 type AddRoomQuery struct {
-	Title      string `schema:"title,required"`
-	StreamerID string `schema:"streamerID,required"`
-	Version    string `schema:"version,required"`
-	Private    bool   `schema:"private"`
+	Title      string             `schema:"title,required"`
+	StreamerID string             `schema:"streamerID,required"`
+	Version    string             `schema:"version,required"`
+	Private    bool               `schema:"private"`
+	Delay      uint64             `schema:"delay"`   // milliseconds, server default if not set
+	Mode       message.StreamMode `schema:"mode"`    // block mode if not set
+	Replace    bool               `schema:"replace"` // take over a room that is streaming
+	Session    string             `schema:"session"` // a room streaming the same session is streamer reconnecting
+}
+
+// Delay of room streamer asked for, or an error if server doesn't support it
+func (q AddRoomQuery) RoomDelay() (uint64, error) {
+	// direct mode has no delay
+	if q.Mode == message.MDirect {
+		return 0, nil
+	}
+	if q.Delay == 0 {
+		return cfg.ROOM_DEFAULT_DELAY, nil
+	}
+	if q.Delay < cfg.ROOM_MIN_DELAY || q.Delay > cfg.ROOM_MAX_DELAY {
+		return 0, fmt.Errorf("Delay must be between %dms and %dms", cfg.ROOM_MIN_DELAY, cfg.ROOM_MAX_DELAY)
+	}
+	return q.Delay, nil
+}
+
+func (q AddRoomQuery) RoomMode() (message.StreamMode, error) {
+	switch q.Mode {
+	case "":
+		return message.MBlock, nil
+	case message.MBlock, message.MDirect:
+		return q.Mode, nil
+	default:
+		return "", fmt.Errorf("Unknown stream mode: %s", q.Mode)
+	}
 }
 
 type AddRoomBody struct {
@@ -102,6 +137,17 @@ func (s *Server) handleAddRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	delay, err := q.RoomDelay()
+	if err != nil {
+		http.Error(w, err.Error(), 422)
+		return
+	}
+	mode, err := q.RoomMode()
+	if err != nil {
+		http.Error(w, err.Error(), 422)
+		return
+	}
+
 	var b AddRoomBody
 	err = json.NewDecoder(r.Body).Decode(&b)
 	if err != nil {
@@ -110,12 +156,21 @@ func (s *Server) handleAddRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r, ok := s.rooms[q.StreamerID]; !ok {
+	if r, ok := s.getRoom(q.StreamerID); !ok {
 		if len(b.Secret) == 0 {
 			http.Error(w, "Secret must be non-empty", 400)
 			return
 		}
 
+		if authorized, err := s.db.Authorize(q.StreamerID, b.Secret); err != nil {
+			log.Printf("Failed to check owner of %s: %s", q.StreamerID, err)
+			http.Error(w, "Failed to create room", 500)
+			return
+		} else if !authorized {
+			http.Error(w, "Username is taken, you're not authorized to stream under it", 401)
+			return
+		}
+
 		if q.Private {
 			if len(b.Key) < 6 {
 				http.Error(w, "Key must be more than 6 characters", 400)
@@ -123,28 +178,37 @@ func (s *Server) handleAddRoom(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		_, err := s.NewRoom(q.StreamerID, q.Title, b.Secret, q.Private, b.Key)
+		newRoom, err := s.NewRoom(q.StreamerID, q.Title, b.Secret, q.Private, b.Key, delay, mode)
 		if err != nil {
 			log.Printf("Failed to add room: %s", err)
 			http.Error(w, "Failed to create room", 400)
 			return
 		}
+		newRoom.SetSession(q.Session)
 
-		log.Printf("Added a room %s, %s, %v", q.StreamerID, q.Title, q.Private)
+		log.Printf("Added a room %s, %s, %v, mode: %s, delay: %dms", q.StreamerID, q.Title, q.Private, mode, delay)
 		w.WriteHeader(http.StatusOK)
 		return
 	} else {
-		if s.rooms[q.StreamerID].Secret() != b.Secret {
-			log.Printf("not authorized %s, %s", s.rooms[q.StreamerID].Secret(), b.Secret)
+		if r.Secret() != b.Secret {
+			log.Printf("not authorized %s, %s", r.Secret(), b.Secret)
 			http.Error(w, "Room existed and you're not authorized to access this room", 401)
 			return
+		} else if r.Status() == message.RStreaming && !q.Replace && (q.Session == "" || q.Session != r.Session()) {
+			// Leave the session alone until streamer confirms to replace it, unless it's the same session reconnecting
+			log.Printf("Room existed: %s", q.StreamerID)
+			http.Error(w, "Room existed", 400)
+			return
 		} else {
 			// Reset info
 			r.SetTitle(q.Title)
 			r.SetPrivate(q.Private)
 			r.SetKey(b.Key)
-			log.Printf("Room existed: %s", q.StreamerID)
-			http.Error(w, "Room existed", 400)
+			r.SetDelay(delay)
+			r.SetMode(mode)
+			r.SetSession(q.Session)
+			log.Printf("Reset room: %s, mode: %s, delay: %dms", q.StreamerID, mode, delay)
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 	}
@@ -154,7 +218,7 @@ func (s *Server) handleAddRoom(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleRoomStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	roomName := vars["roomName"]
-	if room, ok := s.rooms[roomName]; ok {
+	if room, ok := s.getRoom(roomName); ok {
 		json.NewEncoder(w).Encode(room.Summary())
 		return
 	} else {
@@ -185,11 +249,11 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	roomName := vars["roomName"]
 
 	log.Printf("new connection at room :%s", roomName)
-	if _, ok := s.rooms[roomName]; !ok {
+	room, ok := s.getRoom(roomName)
+	if !ok {
 		http.Error(w, "Room not existed", 400)
 		return
 	}
-	room := s.rooms[roomName]
 
 	conn, err := httpUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -197,21 +261,13 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	// Wait for client info
-	msg := message.Wrapper{}
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	err = conn.ReadJSON(&msg)
-	conn.SetReadDeadline(time.Time{}) // reset, there will be no time out for future request
-
-	if err != nil || msg.Type != message.TClientInfo {
-		graceClose(conn, fmt.Sprintf("Required client info message, got : %s", msg.Type))
+	clientInfo, err := readClientInfo(conn)
+	if err != nil {
+		graceClose(conn, err.Error())
 		return
 	}
 
-	clientInfo := message.ClientInfo{}
-	err = message.ToStruct(msg.Data, &clientInfo)
-	if err != nil {
-		graceClose(conn, "Failed to decode message")
+	if !negotiate(conn, clientInfo, room.Mode()) {
 		return
 	}
 
@@ -248,7 +304,7 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	case message.RStreamerChat, message.RProducerRTC:
 		if isAuthorized(clientInfo.Secret, room.Secret()) {
 			clientID := room.NewClientID()
-			room.AddClient(clientID, clientRole, conn) // Blocking call
+			room.AddClient(clientID, clientInfo, conn) // Blocking call
 		} else {
 			graceClose(conn, "Unauthorized")
 			log.Printf("Unauthorized: %s", clientRole)
@@ -261,7 +317,7 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Unauthorized: %s", clientRole)
 		} else {
 			clientID := room.NewClientID()
-			room.AddClient(clientID, clientRole, conn) // Blocking call
+			room.AddClient(clientID, clientInfo, conn) // Blocking call
 		}
 		return
 
@@ -271,6 +327,289 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 
 }
 
+/*** Replay API ***/
+type ReplayInfo struct {
+	message.RoomInfo
+	Duration int64 // Length of the recording in milliseconds
+}
+
+// Find a stopped room and its recording
+// Return http status code when the recording can't be served
+func (s *Server) getRecordedRoom(r *http.Request) (message.RoomInfo, string, int, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		return message.RoomInfo{}, "", 400, fmt.Errorf("Invalid room id")
+	}
+
+	roomInfo, err := s.db.GetRoom(id)
+	if err != nil {
+		return roomInfo, "", 404, fmt.Errorf("Room not existed")
+	}
+
+	if roomInfo.Status != message.RStopped {
+		return roomInfo, "", 400, fmt.Errorf("Room is still streaming")
+	}
+
+	// Room key is not persisted so there is no way to verify viewers of a private room
+	if roomInfo.Private {
+		return roomInfo, "", 403, fmt.Errorf("Private room can't be replayed")
+	}
+
+	if s.recordDir == "" {
+		return roomInfo, "", 404, fmt.Errorf("Recording is disabled")
+	}
+
+	path := record.Path(s.recordDir, id)
+	if _, err := os.Stat(path); err != nil {
+		return roomInfo, "", 404, fmt.Errorf("Recording not found")
+	}
+
+	return roomInfo, path, 200, nil
+}
+
+func (s *Server) handleReplayInfo(w http.ResponseWriter, r *http.Request) {
+	roomInfo, path, code, err := s.getRecordedRoom(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	duration, err := room.RecordDuration(path)
+	if err != nil {
+		log.Printf("Failed to read recording of room %d: %s", roomInfo.Id, err)
+	}
+
+	json.NewEncoder(w).Encode(ReplayInfo{RoomInfo: roomInfo, Duration: duration})
+}
+
+// Viewers connect to a replay exactly the same as connecting to a live room
+func (s *Server) handleReplayWS(w http.ResponseWriter, r *http.Request) {
+	roomInfo, path, code, err := s.getRecordedRoom(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	conn, err := httpUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade to websocket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	clientInfo, err := readClientInfo(conn)
+	if err != nil {
+		graceClose(conn, err.Error())
+		return
+	}
+
+	if clientInfo.Role != message.RViewer {
+		graceClose(conn, "Replay only accept viewers")
+		log.Printf("Invalid replay client role: %s", clientInfo.Role)
+		return
+	}
+
+	if !negotiate(conn, clientInfo, roomInfo.Mode) {
+		return
+	}
+
+	log.Printf("New replay viewer for room: %d", roomInfo.Id)
+	replay := room.NewReplay(roomInfo, path)
+	replay.AddViewer(conn, clientInfo.Encoding) // Blocking call
+}
+
+/*** Upload recording API ***/
+// Create a stopped room from a session streamer recorded while offline
+// Queries are the same as add room API
+// Form fields:
+// - secret : streamer's secret
+// - record : recording file
+// - index  : keyframe index of the recording. Optional
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	var q AddRoomQuery
+	if err := decoder.Decode(&q, r.URL.Query()); err != nil {
+		log.Printf("Failed to decode queries:%s", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if compareVer(q.Version, cfg.SERVER_STREAMER_REQUIRED_VERSION) == -1 {
+		log.Printf("Streamer version is too old: %s", q.Version)
+		http.Error(w, "Upgraded required", 426)
+		return
+	}
+
+	if s.recordDir == "" {
+		http.Error(w, "Recording is disabled", 404)
+		return
+	}
+
+	delay, err := q.RoomDelay()
+	if err != nil {
+		http.Error(w, err.Error(), 422)
+		return
+	}
+	mode, err := q.RoomMode()
+	if err != nil {
+		http.Error(w, err.Error(), 422)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.SERVER_MAX_UPLOAD_SIZE<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		log.Printf("Failed to parse upload: %s", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	secret := r.FormValue("secret")
+	if len(secret) == 0 {
+		http.Error(w, "Secret must be non-empty", 400)
+		return
+	}
+
+	// Username is taken by a live room or was used before by someone else
+	if liveRoom, ok := s.getRoom(q.StreamerID); ok && liveRoom.Secret() != secret {
+		http.Error(w, "Room existed and you're not authorized to access this room", 401)
+		return
+	}
+	if authorized, err := s.db.Authorize(q.StreamerID, secret); err != nil {
+		log.Printf("Failed to check owner of %s: %s", q.StreamerID, err)
+		http.Error(w, "Failed to save recording", 500)
+		return
+	} else if !authorized {
+		http.Error(w, "Username is taken, you're not authorized to upload under it", 401)
+		return
+	}
+
+	recording, _, err := r.FormFile("record")
+	if err != nil {
+		http.Error(w, "Missing recording", 400)
+		return
+	}
+	defer recording.Close()
+
+	// Keep the upload aside until we know it's a valid recording
+	if err := os.MkdirAll(s.recordDir, 0770); err != nil {
+		log.Printf("Failed to create record directory: %s", err)
+		http.Error(w, "Failed to save recording", 500)
+		return
+	}
+	tmp, err := ioutil.TempFile(s.recordDir, "upload-*.gz")
+	if err != nil {
+		log.Printf("Failed to create upload file: %s", err)
+		http.Error(w, "Failed to save recording", 500)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, recording)
+	tmp.Close()
+	if err != nil {
+		log.Printf("Failed to save upload: %s", err)
+		http.Error(w, "Failed to save recording", 500)
+		return
+	}
+
+	startedTime, duration, err := room.RecordTimes(tmp.Name())
+	if err != nil {
+		log.Printf("Invalid uploaded recording: %s", err)
+		http.Error(w, fmt.Sprintf("Invalid recording: %s", err), 400)
+		return
+	}
+
+	roomInfo := message.RoomInfo{
+		StreamerID:     q.StreamerID,
+		Title:          q.Title,
+		Status:         message.RStopped,
+		Delay:          delay,
+		Mode:           mode,
+		StartedTime:    startedTime,
+		LastActiveTime: startedTime.Add(time.Duration(duration) * time.Millisecond),
+	}
+	roomInfo.Id, err = s.db.AddRoom(roomInfo)
+	if err != nil {
+		log.Printf("Failed to add room: %s", err)
+		http.Error(w, "Failed to create room", 500)
+		return
+	}
+
+	path := record.Path(s.recordDir, roomInfo.Id)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		log.Printf("Failed to save recording of room %d: %s", roomInfo.Id, err)
+		http.Error(w, "Failed to save recording", 500)
+		return
+	}
+
+	// Replays work without an index, they just can't seek as fast
+	if index, _, err := r.FormFile("index"); err == nil {
+		if keyframes, err := record.ReadIndex(index, path); err != nil {
+			log.Printf("Dropped invalid index of room %d: %s", roomInfo.Id, err)
+		} else if err := record.WriteIndex(path, keyframes); err != nil {
+			log.Printf("Failed to save index of room %d: %s", roomInfo.Id, err)
+		}
+		index.Close()
+	}
+
+	log.Printf("Uploaded a room %d, %s, %s", roomInfo.Id, q.StreamerID, q.Title)
+	json.NewEncoder(w).Encode(roomInfo)
+}
+
+/*** Export API ***/
+// Queries:
+// - format - string : Format of exported file. Currently support: asciicast
+type ExportQuery struct {
+	Format string `schema:"format"`
+}
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	var q ExportQuery
+	if err := decoder.Decode(&q, r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	roomInfo, path, code, err := s.getRecordedRoom(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	switch q.Format {
+	case "asciicast", "":
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%d.cast\"", roomInfo.Id))
+		if err := room.ExportAsciicast(path, roomInfo, w); err != nil {
+			log.Printf("Failed to export room %d: %s", roomInfo.Id, err)
+		}
+	default:
+		http.Error(w, "Invalid format", 400)
+	}
+}
+
+// Any websocket connection has to start with a client info message
+func readClientInfo(conn *websocket.Conn) (message.ClientInfo, error) {
+	clientInfo := message.ClientInfo{}
+
+	// Wait for client info
+	msg := message.Wrapper{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := conn.ReadJSON(&msg)
+	conn.SetReadDeadline(time.Time{}) // reset, there will be no time out for future request
+
+	if err != nil || msg.Type != message.TClientInfo {
+		return clientInfo, fmt.Errorf("Required client info message, got : %s", msg.Type)
+	}
+
+	err = message.ToStruct(msg.Data, &clientInfo)
+	if err != nil {
+		return clientInfo, fmt.Errorf("Failed to decode message")
+	}
+	return clientInfo, nil
+}
+
 // a > b => 1
 // a < b => -1
 // a = b => 0
@@ -308,7 +647,67 @@ func compareVer(a, b string) int {
 	return ret
 }
 
-func graceClose(conn *websocket.Conn, message string) {
+// Reject clients speaking a protocol server doesn't support,
+// reply the negotiated protocol to the others. Return false if client is rejected
+func negotiate(conn *websocket.Conn, clientInfo message.ClientInfo, mode message.StreamMode) bool {
+	version := clientInfo.ProtocolVersion
+	if version == 0 {
+		version = 1
+	}
+	if version < cfg.SERVER_PROTOCOL_MIN_VERSION {
+		log.Printf("Client protocol version is too old: %d", version)
+		graceClose(conn, fmt.Sprintf("Protocol version %d is no longer supported. Please update TStream", version))
+		return false
+	}
+
+	switch clientInfo.Encoding {
+	case "", message.EJSON, message.EBinary:
+	default:
+		log.Printf("Unknown encoding: %s", clientInfo.Encoding)
+		graceClose(conn, fmt.Sprintf("Unknown encoding: %s", clientInfo.Encoding))
+		return false
+	}
+
+	switch clientInfo.Policy {
+	case "", message.PDropOldest, message.PSnapshot, message.PDisconnect:
+	default:
+		log.Printf("Unknown policy: %s", clientInfo.Policy)
+		graceClose(conn, fmt.Sprintf("Unknown policy: %s", clientInfo.Policy))
+		return false
+	}
+
+	// Clients without version have no capabilities
+	protocol := message.Negotiate(
+		message.Protocol{Version: cfg.PROTOCOL_VERSION, Capabilities: message.CAPABILITIES},
+		message.Protocol{Version: version, Capabilities: clientInfo.Capabilities})
+
+	if clientInfo.Role == message.RViewer && mode == message.MDirect && !protocol.Has(message.CDirect) {
+		graceClose(conn, "This stream is in low latency mode, your client doesn't support it. Please update TStream")
+		return false
+	}
+	if clientInfo.Encoding == message.EBinary && !protocol.Has(message.CBinary) {
+		graceClose(conn, "Binary encoding requires the Binary capability")
+		return false
+	}
+
+	// Clients without version don't expect a reply
+	if clientInfo.ProtocolVersion == 0 {
+		return true
+	}
+
+	if err := conn.WriteJSON(message.Wrapper{Type: message.TProtocol, Data: protocol}); err != nil {
+		log.Printf("Failed to send protocol: %s", err)
+		return false
+	}
+	return true
+}
+
+// Close connection, clients get the reason as an error message if it's not empty
+func graceClose(conn *websocket.Conn, reason string) {
+	if reason != "" {
+		conn.WriteJSON(message.Wrapper{Type: message.TError, Data: message.Error{Message: reason}})
+	}
 	conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Second))
-	time.Sleep(CLOSE_GRACE_PERIOD * time.Second)
+	time.Sleep(CLOSE_GRACE_PERIOD)
+	conn.Close()
 }
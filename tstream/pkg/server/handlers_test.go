@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+)
+
+func addRoom(t *testing.T, url string, delay int, replace bool) int {
+	t.Helper()
+	return addSession(t, url, "", delay, replace)
+}
+
+// Add room as a streaming session of streamer
+func addSession(t *testing.T, url, session string, delay int, replace bool) int {
+	t.Helper()
+	query := fmt.Sprintf("streamerID=%s&title=new&version=%s&delay=%d&replace=%t&session=%s", raceRoom, cfg.STREAMER_VERSION, delay, replace, session)
+	resp, err := http.Post(url+"/api/room?"+query, "application/json", strings.NewReader(fmt.Sprintf(`{"secret": "%s"}`, raceSecret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAddExistingRoom(t *testing.T) {
+	s, url, _ := raceServer(t)
+	r, _ := s.getRoom(raceRoom)
+
+	// nobody is streaming, streamer takes the room right away
+	r.SetStatus(message.RStopped)
+	if code := addRoom(t, url, 2000, false); code != 200 || r.Delay() != 2000 || r.Title() != "new" {
+		t.Errorf("Got %d, delay %d and title %s, want the room reset", code, r.Delay(), r.Title())
+	}
+
+	// a live session is left alone until streamer confirms
+	r.SetStatus(message.RStreaming)
+	if code := addRoom(t, url, 3000, false); code != 400 || r.Delay() != 2000 {
+		t.Errorf("Got %d and delay %d, want the room untouched", code, r.Delay())
+	}
+	if code := addRoom(t, url, 3000, true); code != 200 || r.Delay() != 3000 {
+		t.Errorf("Got %d and delay %d, want the room replaced", code, r.Delay())
+	}
+}
+
+func TestAddRoomSession(t *testing.T) {
+	s, url, _ := raceServer(t)
+	r, _ := s.getRoom(raceRoom)
+
+	// the session that streams the room is reconnecting
+	r.SetStatus(message.RStopped)
+	if code := addSession(t, url, "first", 2000, false); code != 200 {
+		t.Errorf("Got %d, want the room taken", code)
+	}
+	r.SetStatus(message.RStreaming)
+	if code := addSession(t, url, "first", 2000, false); code != 200 {
+		t.Errorf("Got %d, want the same session to reconnect", code)
+	}
+
+	// another session has to replace it, after that the first one can't reconnect
+	if code := addSession(t, url, "second", 2000, false); code != 400 {
+		t.Errorf("Got %d, want another session refused", code)
+	}
+	if code := addSession(t, url, "second", 2000, true); code != 200 {
+		t.Errorf("Got %d, want another session to replace it", code)
+	}
+	if code := addSession(t, url, "first", 2000, false); code != 400 {
+		t.Errorf("Got %d, want the replaced session refused", code)
+	}
+}
+
+// Server replies an error to clients it can't serve
+func expectRejected(t *testing.T, wsURL string, clientInfo message.ClientInfo) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send(conn, message.Wrapper{Type: message.TClientInfo, Data: clientInfo})
+
+	msg := message.Wrapper{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != message.TError {
+		t.Errorf("Got %s: %v, want an error", msg.Type, err)
+	}
+}
+
+func TestUnknownEncoding(t *testing.T) {
+	_, _, wsURL := raceServer(t)
+	expectRejected(t, wsURL, message.ClientInfo{Role: message.RViewer, Encoding: "XML"})
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	_, _, wsURL := raceServer(t)
+	expectRejected(t, wsURL, message.ClientInfo{Role: message.RViewer, Policy: "Wait"})
+}
+
+// Clients without protocol version can't render rooms in direct mode
+func TestLegacyDirect(t *testing.T) {
+	s, _, wsURL := raceServer(t)
+	r, _ := s.getRoom(raceRoom)
+	r.SetMode(message.MDirect)
+	expectRejected(t, wsURL, message.ClientInfo{Role: message.RViewer})
+}
+
+// Recording of two gzip members, return offset of the second one
+func uploadRecording(t *testing.T, path string) int64 {
+	t.Helper()
+	f, err := record.CreateGZ(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer record.CloseGZ(f)
+
+	write := func(delay int64) {
+		msg := raceBlock(t, int(delay))
+		msg.Delay = delay
+		data, _ := json.Marshal(msg)
+		if err := record.WriteGZ(f, append(data, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0)
+	pos, err := record.NewMemberGZ(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(1000)
+	return pos
+}
+
+func upload(t *testing.T, url, secret, recordPath, index string) (message.RoomInfo, int) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("secret", secret)
+	part, _ := form.CreateFormFile("record", "record.gz")
+	data, err := ioutil.ReadFile(recordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	if index != "" {
+		part, _ = form.CreateFormFile("index", "record.idx")
+		part.Write([]byte(index))
+	}
+	form.Close()
+
+	query := fmt.Sprintf("streamerID=%s&title=uploaded&version=%s", raceRoom, cfg.STREAMER_VERSION)
+	resp, err := http.Post(url+"/api/room/upload?"+query, form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	roomInfo := message.RoomInfo{}
+	if resp.StatusCode == 200 {
+		json.NewDecoder(resp.Body).Decode(&roomInfo)
+	}
+	return roomInfo, resp.StatusCode
+}
+
+func TestUpload(t *testing.T) {
+	s, url, _ := raceServer(t)
+	path := filepath.Join(t.TempDir(), "record.gz")
+	pos := uploadRecording(t, path)
+
+	tests := []struct {
+		name   string
+		secret string
+		index  string
+		code   int
+		kept   bool
+	}{
+		{"owner", raceSecret, fmt.Sprintf(`{"Delay":0,"Pos":0}`+"\n"+`{"Delay":1000,"Pos":%d}`, pos), 200, true},
+		{"no index", raceSecret, "", 200, false},
+		{"outside recording", raceSecret, `{"Delay":0,"Pos":100000}`, 200, false},
+		{"not a member", raceSecret, `{"Delay":0,"Pos":1}`, 200, false},
+		{"out of order", raceSecret, fmt.Sprintf(`{"Delay":1000,"Pos":%d}`+"\n"+`{"Delay":0,"Pos":0}`, pos), 200, false},
+		{"someone else", "other", "", 401, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomInfo, code := upload(t, url, tt.secret, path, tt.index)
+			if code != tt.code {
+				t.Fatalf("Got %d, want %d", code, tt.code)
+			}
+			if code != 200 {
+				return
+			}
+			if roomInfo.Status != message.RStopped || roomInfo.LastActiveTime.Sub(roomInfo.StartedTime) != time.Second {
+				t.Errorf("Got %+v, want a stopped room lasting 1s", roomInfo)
+			}
+			recordPath := record.Path(s.recordDir, roomInfo.Id)
+			if _, err := os.Stat(recordPath); err != nil {
+				t.Errorf("Recording is missing: %s", err)
+			}
+			if _, err := os.Stat(record.IndexPath(recordPath)); (err == nil) != tt.kept {
+				t.Errorf("Got index saved %t, want %t", err == nil, tt.kept)
+			}
+		})
+	}
+
+	// the owner is remembered after the live room is gone
+	s.deleteRoom(raceRoom)
+	if _, code := upload(t, url, "other", path, ""); code != 401 {
+		t.Errorf("Got %d, want someone else rejected", code)
+	}
+}
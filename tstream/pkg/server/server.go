@@ -10,19 +10,21 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/qnkhuat/tstream/internal/cfg"
 	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
 	"github.com/qnkhuat/tstream/pkg/room"
 	"github.com/rs/cors"
 )
 
 type Server struct {
-	lock   sync.RWMutex
-	rooms  map[string]*room.Room
-	addr   string
-	server *http.Server
-	db     *DB
+	lock      sync.RWMutex
+	rooms     map[string]*room.Room
+	addr      string
+	server    *http.Server
+	db        *DB
+	recordDir string // directory to store session recordings
 }
 
-func New(addr string, db_path string) (*Server, error) {
+func New(addr string, db_path string, record_dir string) (*Server, error) {
 	rooms := make(map[string]*room.Room)
 
 	db, err := SetupDB(db_path)
@@ -32,9 +34,10 @@ func New(addr string, db_path string) (*Server, error) {
 	}
 
 	return &Server{
-		addr:  addr,
-		rooms: rooms,
-		db:    db,
+		addr:      addr,
+		rooms:     rooms,
+		db:        db,
+		recordDir: record_dir,
 	}, nil
 }
 func CORS(next http.Handler) http.Handler {
@@ -56,7 +59,11 @@ func CORS(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) NewRoom(name, title, secret string, private bool, key string) (*room.Room, error) {
+func (s *Server) NewRoom(name, title, secret string, private bool, key string, delay uint64, mode message.StreamMode) (*room.Room, error) {
+	// hold the lock until room is added so a name can't be taken twice
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	var r *room.Room
 	if _, ok := s.rooms[name]; ok {
 		return r, fmt.Errorf("Room %s existed", name)
@@ -64,31 +71,43 @@ func (s *Server) NewRoom(name, title, secret string, private bool, key string) (
 	r = room.New(name, title, secret)
 	r.SetPrivate(private)
 	r.SetKey(key)
+	r.SetDelay(delay)
+	r.SetMode(mode)
 	msg := r.PrepareRoomInfo()
 	id, err := s.db.AddRoom(msg)
 	if err != nil {
 		return r, err
 	}
 	r.SetId(id)
+	if s.recordDir != "" {
+		r.SetRecordPath(record.Path(s.recordDir, id))
+	}
 	s.rooms[name] = r
 	return r, nil
 }
 
+func (s *Server) getRoom(name string) (*room.Room, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r, ok := s.rooms[name]
+	return r, ok
+}
+
+// A copy of rooms, safe to iterate while rooms are added and removed
+func (s *Server) listRooms() map[string]*room.Room {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	rooms := make(map[string]*room.Room, len(s.rooms))
+	for name, r := range s.rooms {
+		rooms[name] = r
+	}
+	return rooms
+}
+
 func (s *Server) Start() {
 	log.Printf("Serving at: %s", s.addr)
 	fmt.Printf("Serving at: %s\n", s.addr)
-	router := mux.NewRouter()
-	router.Use(CORS)
-
-	router.HandleFunc("/api/health", handleHealth).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/rooms", s.handleListRooms).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/room/{roomName}/status", s.handleRoomStatus).Methods("GET", "OPTIONS")
-	// Add room
-	router.HandleFunc("/api/room", s.handleAddRoom).Queries("streamerID", "{streamerID}", "title", "{title}").Methods("POST", "OPTIONS")
-	router.HandleFunc("/ws/{roomName}", s.handleWS).Methods("GET", "OPTIONS")
-	handler := cors.Default().Handler(router)
-
-	s.server = &http.Server{Addr: s.addr, Handler: handler}
+	s.server = &http.Server{Addr: s.addr, Handler: s.handler()}
 
 	s.scanAndCleanRooms(cfg.SERVER_CLEAN_THRESHOLD)
 	s.syncDB()
@@ -101,6 +120,23 @@ func (s *Server) Start() {
 	}
 }
 
+func (s *Server) handler() http.Handler {
+	router := mux.NewRouter()
+	router.Use(CORS)
+
+	router.HandleFunc("/api/health", handleHealth).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/rooms", s.handleListRooms).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/room/{roomName}/status", s.handleRoomStatus).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/room/{id:[0-9]+}/replay", s.handleReplayInfo).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/room/{id:[0-9]+}/export", s.handleExport).Methods("GET", "OPTIONS")
+	// Add room
+	router.HandleFunc("/api/room/upload", s.handleUpload).Queries("streamerID", "{streamerID}", "title", "{title}").Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/room", s.handleAddRoom).Queries("streamerID", "{streamerID}", "title", "{title}").Methods("POST", "OPTIONS")
+	router.HandleFunc("/ws/{roomName}", s.handleWS).Methods("GET", "OPTIONS")
+	router.HandleFunc("/ws/replay/{id:[0-9]+}", s.handleReplayWS).Methods("GET", "OPTIONS")
+	return cors.Default().Handler(router)
+}
+
 func (s *Server) Stop() {
 	s.server.Close()
 }
@@ -120,7 +156,7 @@ func (s *Server) repeatedlyCleanRooms(interval, idleThreshold int) {
 func (s *Server) scanAndCleanRooms(idleThreshold int) int {
 	threshold := time.Duration(idleThreshold) * time.Second
 	count := 0
-	for roomName, room := range s.rooms {
+	for roomName, room := range s.listRooms() {
 		if time.Since(room.LastActiveTime()) > threshold || room.Status() == message.RStopped {
 			room.Stop(message.RStopped)
 			s.deleteRoom(roomName)
@@ -154,7 +190,7 @@ func (s *Server) syncDB() {
 	toUpdateRooms := map[uint64]message.RoomInfo{}
 
 	// Update all room in RAM
-	for _, room := range s.rooms {
+	for _, room := range s.listRooms() {
 		toUpdateRooms[room.Id()] = room.PrepareRoomInfo()
 	}
 
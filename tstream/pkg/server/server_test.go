@@ -0,0 +1,303 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Run with -race, these tests have streamers, viewers and chats of a room come and go at the same time
+
+const (
+	raceRoom   = "race"
+	raceSecret = "secret"
+)
+
+// Server with one room, return urls of the server and websocket of the room
+func raceServer(t *testing.T) (*Server, string, string) {
+	// rooms keep logging after the test is done
+	log.SetOutput(ioutil.Discard)
+
+	dir := t.TempDir()
+	s, err := New("", filepath.Join(dir, "tstream"), filepath.Join(dir, "records"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewRoom(raceRoom, "race", raceSecret, false, "", cfg.ROOM_MIN_DELAY, message.MBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(s.handler())
+	t.Cleanup(server.Close)
+	return s, server.URL, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/" + raceRoom
+}
+
+// Connect to room as client
+func connect(t *testing.T, url string, clientInfo message.ClientInfo) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Errorf("Failed to connect %s: %s", clientInfo.Role, err)
+		return nil
+	}
+	if err := conn.WriteJSON(message.Wrapper{Type: message.TClientInfo, Data: clientInfo}); err != nil {
+		t.Errorf("Failed to send client info: %s", err)
+	}
+	return conn
+}
+
+// Connect to room as client and read everything server sends until closed
+func dial(t *testing.T, url string, clientInfo message.ClientInfo) *websocket.Conn {
+	conn := connect(t, url, clientInfo)
+	if conn == nil {
+		return nil
+	}
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+// Send messages and leave, errors are ignored because server might close first
+func send(conn *websocket.Conn, msgs ...message.Wrapper) {
+	for _, msg := range msgs {
+		conn.WriteJSON(msg)
+	}
+}
+
+func raceBlock(t *testing.T, i int) message.Wrapper {
+	data, _ := json.Marshal(message.Wrapper{Type: message.TWrite, Data: []byte(fmt.Sprintf("line %d\r\n", i))})
+	block, err := message.EncodeBlock([][]byte{data}, time.Now(), cfg.ROOM_MIN_DELAY*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// Each streamer replaces the previous one like a reconnect
+func raceStreamer(t *testing.T, url string) {
+	conn := dial(t, url, message.ClientInfo{Role: message.RStreamer, Secret: raceSecret})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	send(conn, message.Wrapper{Type: message.TWinsize, Data: message.Winsize{Rows: 24, Cols: 80}})
+	for i := 0; i < 20; i++ {
+		send(conn, raceBlock(t, i))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func raceViewer(t *testing.T, url string, name string) {
+	conn := dial(t, url, message.ClientInfo{Name: name, Role: message.RViewer, LastSeq: 1})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	send(conn,
+		message.Wrapper{Type: message.TRequestRoomInfo},
+		message.Wrapper{Type: message.TRequestCacheContent},
+		message.Wrapper{Type: message.TRequestWinsize},
+		message.Wrapper{Type: message.TRequestCacheChat},
+		message.Wrapper{Type: message.TChat, Data: []message.Chat{{Name: name, Content: "hi"}}},
+	)
+	time.Sleep(10 * time.Millisecond)
+}
+
+// Chat of streamer renames the room and hands control to a viewer that chatted
+func raceChat(t *testing.T, url string, viewer string) {
+	conn := connect(t, url, message.ClientInfo{Name: "streamer", Role: message.RStreamerChat, Secret: raceSecret})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	send(conn,
+		message.Wrapper{Type: message.TChat, Data: []message.Chat{{Name: "streamer", Content: "hello"}}},
+		message.Wrapper{Type: message.TRoomUpdate, Data: message.RoomInfo{Title: viewer}},
+	)
+
+	// viewers are granted by the ID server stamps on their chats
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	for {
+		msg := message.Wrapper{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		var chats []message.Chat
+		if msg.Type != message.TChat || message.ToStruct(msg.Data, &chats) != nil || len(chats) == 0 || chats[0].ID == "" {
+			continue
+		}
+		send(conn,
+			message.Wrapper{Type: message.TControl, Data: message.Control{ID: chats[0].ID, Granted: true}},
+			message.Wrapper{Type: message.TControl, Data: message.Control{Granted: false}},
+		)
+		return
+	}
+}
+
+// What server does in background and what people see from the outside
+func racePoll(t *testing.T, s *Server, url string) {
+	s.syncDB()
+	s.scanAndCleanRooms(cfg.SERVER_CLEAN_THRESHOLD)
+	for _, path := range []string{"/api/room/" + raceRoom + "/status", "/api/rooms"} {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Errorf("Failed to get %s: %s", path, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestRaceRoom(t *testing.T) {
+	s, url, wsURL := raceServer(t)
+
+	var wg sync.WaitGroup
+	run := func(n int, f func(i int)) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					f(i)
+				}
+			}(i)
+		}
+	}
+
+	run(3, func(i int) { raceStreamer(t, wsURL) })
+	run(20, func(i int) { raceViewer(t, wsURL, fmt.Sprintf("viewer-%d", i)) })
+	run(3, func(i int) { raceChat(t, wsURL, fmt.Sprintf("viewer-%d", i)) })
+	run(3, func(i int) { racePoll(t, s, url) })
+	wg.Wait()
+
+	r, ok := s.getRoom(raceRoom)
+	if !ok {
+		t.Fatal("Room is gone")
+	}
+	// viewers are removed once server notices they left
+	deadline := time.Now().Add(5 * time.Second)
+	for r.NViewers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := r.PrepareRoomInfo()
+	if info.NViewers != 0 || info.AccNViewers != 100 || len(info.Collaborators) != 0 {
+		t.Errorf("Room has %d viewers of %d and collaborators %v, want 0 of 100 and none", info.NViewers, info.AccNViewers, info.Collaborators)
+	}
+	if !strings.HasPrefix(info.Title, "viewer-") {
+		t.Errorf("Room title is %s, want one set by chat", info.Title)
+	}
+}
+
+// Rooms are added and looked up while others are in use
+func TestRaceRooms(t *testing.T) {
+	s, url, _ := raceServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		name := fmt.Sprintf("room-%d", i)
+		go func() {
+			defer wg.Done()
+			if _, err := s.NewRoom(name, name, raceSecret, false, "", cfg.ROOM_MIN_DELAY, message.MBlock); err != nil {
+				t.Errorf("Failed to add room: %s", err)
+			}
+			// the same name can only be taken once
+			if _, err := s.NewRoom(name, name, raceSecret, false, "", cfg.ROOM_MIN_DELAY, message.MBlock); err == nil {
+				t.Errorf("Room %s is added twice", name)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			racePoll(t, s, url)
+			s.getRoom(name)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(s.listRooms()); n != 11 {
+		t.Errorf("Server has %d rooms, want 11", n)
+	}
+}
+
+// Seq of stream messages viewer gets until it has the one numbered last
+func readSeqs(t *testing.T, conn *websocket.Conn, last uint64) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg := message.Wrapper{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read until seq %d, got %v: %s", last, seqs, err)
+		}
+		if msg.Seq == 0 {
+			continue
+		}
+		seqs = append(seqs, msg.Seq)
+		if msg.Seq == last {
+			return seqs
+		}
+	}
+}
+
+// Viewer that reconnects while streamer keeps streaming gets every message it missed once and in order
+func TestResume(t *testing.T) {
+	_, _, wsURL := raceServer(t)
+
+	streamer := dial(t, wsURL, message.ClientInfo{Role: message.RStreamer, Secret: raceSecret})
+	defer streamer.Close()
+	for i := 0; i < 10; i++ {
+		send(streamer, raceBlock(t, i))
+	}
+
+	// wait until room has all of them
+	watcher, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	send(watcher,
+		message.Wrapper{Type: message.TClientInfo, Data: message.ClientInfo{Role: message.RViewer}},
+		message.Wrapper{Type: message.TRequestCacheContent},
+	)
+	readSeqs(t, watcher, 10)
+
+	go func() {
+		for i := 10; i < 60; i++ {
+			send(streamer, raceBlock(t, i))
+		}
+	}()
+
+	viewer, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+	send(viewer, message.Wrapper{Type: message.TClientInfo, Data: message.ClientInfo{Role: message.RViewer, LastSeq: 5}})
+
+	seqs := readSeqs(t, viewer, 60)
+	for i, seq := range seqs {
+		if seq != uint64(i+6) {
+			t.Fatalf("Got messages %v, want 6 to 60", seqs)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+/*
+SSH gateway for viewers.
+`ssh <room>@host` shows the stream with the chat of room right in terminal, nothing to install.
+Private rooms require the room key as password
+*/
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/room"
+	"github.com/qnkhuat/tstream/pkg/viewer"
+	"github.com/rivo/tview"
+	"golang.org/x/crypto/ssh"
+)
+
+// All sessions are rendered for this terminal
+const SSH_TERM = "xterm-256color"
+
+// width of the chat pane in columns
+const SSH_CHAT_WIDTH = 40
+
+// Serve viewers via SSH. Blocking call
+// Host key is generated at hostKeyPath if it doesn't exist
+func (s *Server) StartSSH(addr, hostKeyPath string) error {
+	hostKey, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		log.Printf("Failed to load SSH host key: %s", err)
+		return err
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return s.authorizeSSH(conn.User(), "")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return s.authorizeSSH(conn.User(), string(password))
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Failed to listen SSH: %s", err)
+		return err
+	}
+	log.Printf("Serving SSH at: %s", addr)
+	fmt.Printf("Serving SSH at: %s\n", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Failed to accept SSH connection: %s", err)
+			return err
+		}
+		go s.handleSSHConn(conn, config)
+	}
+}
+
+// Viewers of public rooms are accepted with any key or password,
+// private rooms require the room key as password
+// Unknown rooms are accepted so viewers are told why they can't watch
+func (s *Server) authorizeSSH(roomName, password string) (*ssh.Permissions, error) {
+	r, ok := s.getRoom(roomName)
+
+	if ok && r.Private() && password != r.Key() {
+		return nil, fmt.Errorf("Unauthorized")
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"key": password}}, nil
+}
+
+func (s *Server) handleSSHConn(netConn net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		log.Printf("Failed SSH handshake: %s", err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Failed to accept SSH channel: %s", err)
+			continue
+		}
+		go s.handleSSHSession(conn, channel, requests)
+	}
+}
+
+func (s *Server) handleSSHSession(conn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	tty := newSSHTty(channel)
+	shell := make(chan bool, 1) // true if session has a pty
+	go func() {
+		hasPty := false
+		for req := range requests {
+			switch req.Type {
+			case "pty-req":
+				ptyReq := struct {
+					Term                      string
+					Cols, Rows, Width, Height uint32
+					Modes                     string
+				}{}
+				if err := ssh.Unmarshal(req.Payload, &ptyReq); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				hasPty = true
+				tty.resize(int(ptyReq.Cols), int(ptyReq.Rows))
+				req.Reply(true, nil)
+
+			case "window-change":
+				winsize := struct {
+					Cols, Rows, Width, Height uint32
+				}{}
+				if err := ssh.Unmarshal(req.Payload, &winsize); err == nil {
+					tty.resize(int(winsize.Cols), int(winsize.Rows))
+				}
+				req.Reply(true, nil)
+
+			case "shell":
+				req.Reply(true, nil)
+				shell <- hasPty
+
+			default:
+				req.Reply(false, nil)
+			}
+		}
+		close(shell)
+	}()
+
+	hasPty, ok := <-shell
+	if !ok {
+		return
+	}
+	defer channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	if !hasPty {
+		fmt.Fprintf(channel, "TStream needs a terminal. Please connect with: ssh -t %s@<host>\r\n", conn.User())
+		return
+	}
+
+	roomName := conn.User()
+	r, ok := s.getRoom(roomName)
+	if !ok || r.Status() == message.RStopped {
+		fmt.Fprintf(channel, "Room %s is not streaming\r\n", roomName)
+		return
+	}
+	if r.Private() && conn.Permissions.Extensions["key"] != r.Key() {
+		fmt.Fprintf(channel, "Unauthorized. Please check the room key\r\n")
+		return
+	}
+
+	v, err := newSSHViewer(r, tty)
+	if err != nil {
+		log.Printf("Failed to create SSH viewer: %s", err)
+		return
+	}
+	log.Printf("New SSH viewer at room: %s", roomName)
+	if err := v.Start(); err != nil { // Blocking call
+		log.Printf("SSH viewer stopped: %s", err)
+	}
+}
+
+// A viewer connected via SSH, served as a local client of room
+type sshViewer struct {
+	name     string
+	chatted  bool // name is fixed once viewer chatted
+	room     *room.Room
+	client   *room.Client
+	app      *tview.Application
+	renderer *viewer.Renderer
+	termView *viewer.TermView
+	chatView *tview.TextView
+}
+
+func newSSHViewer(r *room.Room, tty *sshTty) (*sshViewer, error) {
+	ti, err := tcell.LookupTerminfo(SSH_TERM)
+	if err != nil {
+		return nil, err
+	}
+	screen, err := tcell.NewTerminfoScreenFromTtyTerminfo(tty, ti)
+	if err != nil {
+		return nil, err
+	}
+	if err := screen.Init(); err != nil {
+		return nil, err
+	}
+	// tcell picks the charset from locale of server
+	if charset := screen.CharacterSet(); charset != "UTF-8" {
+		log.Printf("SSH viewers get %s output, run server with an UTF-8 locale to show unicode", charset)
+	}
+
+	app := tview.NewApplication().SetScreen(screen)
+	emu := emulator.New(emulator.DEFAULT_COLS, emulator.DEFAULT_ROWS)
+	return &sshViewer{
+		room:     r,
+		app:      app,
+		renderer: viewer.NewRenderer(emu, func() { app.QueueUpdateDraw(func() {}) }),
+		termView: viewer.NewTermView(emu),
+	}, nil
+}
+
+// Blocking until viewer exits or the stream is stopped
+func (v *sshViewer) Start() error {
+	ID, client, err := v.room.AddLocalClient(message.RViewer)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	v.client = client
+	v.name = fmt.Sprintf("ssh-%s", ID[:4])
+
+	v.app.SetRoot(v.newLayout(), true)
+
+	go v.renderer.Start()
+	defer v.renderer.Stop()
+	go v.readLoop()
+
+	for _, msgType := range []message.MType{message.TRequestRoomInfo, message.TRequestWinsize, message.TRequestCacheContent, message.TRequestCacheChat} {
+		client.In <- message.Wrapper{Type: msgType}
+	}
+
+	v.addNoti(fmt.Sprintf("Watching as [green]%s[white]. Type /help to get list of available commands", v.name))
+	return v.app.Run()
+}
+
+func (v *sshViewer) newLayout() tview.Primitive {
+	v.termView.SetBorder(true).SetTitle(fmt.Sprintf(" @%s ", v.room.Name()))
+
+	v.chatView = tview.NewTextView().
+		SetScrollable(true).
+		SetDynamicColors(true).
+		SetWordWrap(true).
+		ScrollToEnd()
+	v.chatView.SetBorder(true).SetTitle(" Chat ")
+
+	input := tview.NewInputField().SetLabel("[red]>[white] ")
+	input.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
+		}
+		text := strings.TrimSpace(input.GetText())
+		input.SetText("")
+		if strings.HasPrefix(text, "/") {
+			v.handleCommand(strings.Fields(text[1:]))
+		} else if text != "" {
+			v.sendChat(text)
+		}
+	})
+
+	chatPane := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(v.chatView, 0, 1, false).
+		AddItem(input, 1, 0, true)
+
+	return tview.NewFlex().
+		AddItem(v.termView, 0, 1, false).
+		AddItem(chatPane, SSH_CHAT_WIDTH, 0, true)
+}
+
+// Handle messages room sent to viewer until client is closed
+func (v *sshViewer) readLoop() {
+	for {
+		select {
+		case frame := <-v.client.Out:
+			v.handleMessage(frame.Msg)
+		case <-v.client.Done():
+			v.app.Stop()
+			return
+		}
+	}
+}
+
+func (v *sshViewer) handleMessage(msg message.Wrapper) {
+	switch msg.Type {
+
+	case message.TWriteBlock, message.TWinsize, message.TWrite, message.TSnapshot, message.TPause:
+		if err := v.renderer.WriteMsg(msg); err != nil {
+			log.Printf("Failed to render message: %s", err)
+		}
+
+	case message.TRoomInfo:
+		roomInfo := message.RoomInfo{}
+		if err := message.ToStruct(msg.Data, &roomInfo); err == nil {
+			v.renderer.SetDelay(time.Duration(roomInfo.Delay) * time.Millisecond)
+			v.app.QueueUpdateDraw(func() {
+				v.termView.SetTitle(fmt.Sprintf(" @%s - %s ", roomInfo.StreamerID, tview.Escape(roomInfo.Title)))
+			})
+		}
+
+	case message.TChat:
+		var chatList []message.Chat
+		if err := message.ToStruct(msg.Data, &chatList); err == nil {
+			v.app.QueueUpdateDraw(func() { v.addChats(chatList) })
+		}
+
+	case message.TClose:
+		closeMsg := message.Close{}
+		if err := message.ToStruct(msg.Data, &closeMsg); err == nil {
+			v.app.QueueUpdateDraw(func() {
+				v.addNoti(fmt.Sprintf("[yellow]%s exited with code %d[white]", tview.Escape(closeMsg.Command), closeMsg.ExitCode))
+			})
+		}
+	}
+}
+
+func (v *sshViewer) sendChat(content string) {
+	chat := message.Chat{
+		Name:    v.name,
+		Content: content,
+		Color:   "green",
+		Time:    time.Now().String(),
+		Role:    message.RViewer,
+	}
+	chatList := []message.Chat{chat}
+	v.client.In <- message.Wrapper{Type: message.TChat, Data: chatList}
+	v.chatted = true
+	v.addChats(chatList)
+}
+
+func (v *sshViewer) handleCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+
+	switch args[0] {
+	case "help":
+		v.addNoti(`TStream - Streaming from terminal
+  [green]/name[yellow] name[white] - to change your name in chat, before you chat
+  [green]/exit[white] - to exit room`)
+
+	case "name":
+		if v.chatted {
+			v.addNoti(fmt.Sprintf("[yellow]Name can't be changed after chatting, you are %s[white]", tview.Escape(v.name)))
+		} else if len(args) > 1 {
+			v.name = strings.Join(args[1:], " ")
+			v.addNoti(fmt.Sprintf("[yellow]Changed name to: %s[white]", tview.Escape(v.name)))
+		} else {
+			v.addNoti("[yellow]/name : no name found[white]")
+		}
+
+	case "exit":
+		v.app.Stop()
+
+	default:
+		v.addNoti("Unknown command. Type /help to get list of available commands.")
+	}
+}
+
+// Chats are escaped since they come from other viewers
+func (v *sshViewer) addChats(chatList []message.Chat) {
+	for _, chat := range chatList {
+		if strings.TrimSpace(chat.Content) == "" {
+			continue
+		}
+		// notifications from server have no sender
+		if chat.Name == "" {
+			v.addNoti(fmt.Sprintf("[yellow]%s[white]", tview.Escape(strings.TrimSpace(chat.Content))))
+			continue
+		}
+		color := chat.Color
+		if color == "" {
+			color = "white"
+		}
+		fmt.Fprintf(v.chatView, "[%s]%s[white]: %s\n", tview.Escape(color), tview.Escape(chat.Name), tview.Escape(strings.TrimSpace(chat.Content)))
+	}
+}
+
+func (v *sshViewer) addNoti(msg string) {
+	fmt.Fprintf(v.chatView, "%s\n", msg)
+}
+
+// Load a host key or generate a new one if it doesn't exist
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("Generating SSH host key at: %s", path)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
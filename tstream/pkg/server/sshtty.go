@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Let tcell draw on a SSH channel as if it's a terminal
+type sshTty struct {
+	ssh.Channel
+
+	lock     sync.Mutex
+	cols     int
+	rows     int
+	onResize func()
+
+	// input read from channel
+	input   chan []byte
+	pending []byte
+
+	// closed to wake up Read when tcell stops reading
+	drain chan struct{}
+}
+
+func newSSHTty(channel ssh.Channel) *sshTty {
+	t := &sshTty{
+		Channel: channel,
+		cols:    80,
+		rows:    24,
+		input:   make(chan []byte),
+		drain:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(t.input)
+		for {
+			buf := make([]byte, 128)
+			n, err := channel.Read(buf)
+			if n > 0 {
+				t.input <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *sshTty) resize(cols, rows int) {
+	t.lock.Lock()
+	t.cols = cols
+	t.rows = rows
+	onResize := t.onResize
+	t.lock.Unlock()
+
+	if onResize != nil {
+		onResize()
+	}
+}
+
+func (t *sshTty) Start() error {
+	t.lock.Lock()
+	t.drain = make(chan struct{})
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *sshTty) Stop() error {
+	return nil
+}
+
+func (t *sshTty) Drain() error {
+	t.lock.Lock()
+	close(t.drain)
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *sshTty) NotifyResize(cb func()) {
+	t.lock.Lock()
+	t.onResize = cb
+	t.lock.Unlock()
+}
+
+func (t *sshTty) WindowSize() (int, int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.cols, t.rows, nil
+}
+
+func (t *sshTty) Read(p []byte) (int, error) {
+	if len(t.pending) == 0 {
+		t.lock.Lock()
+		drain := t.drain
+		t.lock.Unlock()
+
+		select {
+		case data, ok := <-t.input:
+			if !ok {
+				return 0, io.EOF
+			}
+			t.pending = data
+		case <-drain:
+			return 0, nil
+		}
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
@@ -12,17 +12,22 @@ import (
 	"github.com/qnkhuat/mediadevices/pkg/codec/opus"
 	_ "github.com/qnkhuat/mediadevices/pkg/driver/microphone" // This is required to register microphone adapter
 	"github.com/qnkhuat/mediadevices/pkg/prop"
+	"github.com/qnkhuat/tstream/internal/cfg"
 	"github.com/qnkhuat/tstream/pkg/message"
 	"github.com/rivo/tview"
 	"log"
 	"math"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 var decoder = schema.NewDecoder()
 
+// Server rejected the secret or key of client
+var errUnauthorized = fmt.Errorf("Unauthorized connection")
+
 const mtu int = 1600
 
 type MediaSession struct {
@@ -35,6 +40,8 @@ type Chat struct {
 	sessionId        string
 	serverAddr       string
 	color            string
+	role             message.CRole          // RStreamerChat or RViewer
+	onMessage        func(message.Wrapper)  // handle messages that are not about chat
 	wsConn           *websocket.Conn        // for chat and roominfo
 	peerConn         *webrtc.PeerConnection // for voice
 	mediaSession     *MediaSession
@@ -46,6 +53,10 @@ type Chat struct {
 	titleTextView    *tview.TextView
 	muteBtn          *tview.Button
 	mute             bool
+	collaborators    []string // viewers who have control of streamer's shell
+
+	viewersLock sync.Mutex
+	viewers     map[string]string // client ID of viewers by their chat name
 
 	lastToggleMute time.Time
 }
@@ -56,8 +67,10 @@ func NewChat(sessionId, serverAddr, username string) *Chat {
 		sessionId:  sessionId,
 		serverAddr: serverAddr,
 		color:      "red",
+		role:       message.RStreamerChat,
 		app:        tview.NewApplication(),
 		mute:       true,
+		viewers:    make(map[string]string),
 	}
 }
 
@@ -88,16 +101,25 @@ func (c *Chat) StartChatService() error {
 	}
 
 	c.wsConn = conn
+	c.startService()
+	return nil
+}
 
+// Handle messages from server and keep room info up to date. Require a connection to server
+func (c *Chat) startService() {
 	go func() {
 		for {
-			msg := message.Wrapper{}
-			err := c.wsConn.ReadJSON(&msg)
+			msgType, data, err := c.wsConn.ReadMessage()
 			if err != nil {
 				log.Printf("Failed to read message: %s", err)
 				c.Stop(fmt.Sprintf("Failed to read connect to server"))
 				return
 			}
+			msg, err := message.Decode(data, msgType == websocket.BinaryMessage)
+			if err != nil {
+				log.Printf("Failed to decode message: %s", err)
+				continue
+			}
 
 			switch msg.Type {
 			case message.TChat:
@@ -108,6 +130,7 @@ func (c *Chat) StartChatService() error {
 					c.Stop("Failed to decode message from server")
 					return
 				}
+				c.addViewers(chatList)
 				c.addChatMsgs(chatList)
 			case message.TRoomInfo:
 				roomInfo := message.RoomInfo{}
@@ -119,13 +142,30 @@ func (c *Chat) StartChatService() error {
 				} else {
 					c.startedTime = roomInfo.StartedTime
 					c.nviewersTextView.SetText(fmt.Sprintf("%d 👤", roomInfo.NViewers))
-					c.titleTextView.SetText(fmt.Sprintf("%s", roomInfo.Title))
+					c.updateCollaborators(roomInfo.Collaborators)
+					title := roomInfo.Title
+					if len(c.collaborators) > 0 {
+						title += fmt.Sprintf(" [yellow]⌨ %s[white]", strings.Join(c.collaborators, ", "))
+					}
+					c.titleTextView.SetText(title)
+				}
+
+			case message.TClose:
+				closeMsg := message.Close{}
+				if err := message.ToStruct(msg.Data, &closeMsg); err == nil {
+					c.addNoti(fmt.Sprintf("[yellow]%s exited with code %d[white]", closeMsg.Command, closeMsg.ExitCode))
 				}
 
 			default:
-				log.Printf("Not implemented to handle message type: %s", msg.Type)
+				if c.onMessage == nil {
+					log.Printf("Not implemented to handle message type: %s", msg.Type)
+				}
 
 			}
+
+			if c.onMessage != nil {
+				c.onMessage(msg)
+			}
 		}
 	}()
 
@@ -135,7 +175,9 @@ func (c *Chat) StartChatService() error {
 	go func() {
 		time.Sleep(1 * time.Second)
 		c.addNoti("[yellow]Type /help to get list of available commands[white]")
-		c.addNoti("[yellow]Voice chat is off. Type /unmute to turn on voice chat[white]")
+		if c.role == message.RStreamerChat {
+			c.addNoti("[yellow]Voice chat is off. Type /unmute to turn on voice chat[white]")
+		}
 	}()
 
 	go func() {
@@ -166,7 +208,6 @@ func (c *Chat) StartChatService() error {
 			}
 		}
 	}()
-	return nil
 }
 
 func GetMediaSession() (*MediaSession, error) {
@@ -405,6 +446,12 @@ func (c *Chat) requestServer(msgType message.MType) error {
 }
 
 func (c *Chat) initUI() error {
+	c.app.SetRoot(c.newLayout(), true)
+	return nil
+}
+
+// Build the chat pane: room info, chat messages and an input
+func (c *Chat) newLayout() tview.Primitive {
 	layout := tview.NewGrid().
 		SetRows(4, 0, 1).
 		SetColumns(0).
@@ -416,7 +463,7 @@ func (c *Chat) initUI() error {
 
 	usernameText := tview.NewTextView().
 		SetDynamicColors(true).
-		SetText(fmt.Sprintf("@%s", c.username))
+		SetText(fmt.Sprintf("@%s", c.sessionId))
 
 	c.titleTextView = tview.NewTextView().
 		SetDynamicColors(true).
@@ -456,12 +503,16 @@ func (c *Chat) initUI() error {
 				messageInput.SetText("")
 				return
 			} else {
+				role := message.RStreamer
+				if c.role == message.RViewer {
+					role = message.RViewer
+				}
 				chat := message.Chat{
 					Name:    c.username,
 					Color:   c.color,
 					Content: text,
 					Time:    time.Now().String(),
-					Role:    message.RStreamer,
+					Role:    role,
 				}
 
 				chatList := []message.Chat{chat}
@@ -479,11 +530,16 @@ func (c *Chat) initUI() error {
 		})
 	c.muteBtn.SetBackgroundColor(tcell.ColorBlack)
 
-	footer := tview.NewGrid().
-		SetRows(1).
-		SetColumns(3, 0).
-		AddItem(c.muteBtn, 0, 0, 1, 1, 0, 0, false).
-		AddItem(messageInput, 0, 1, 1, 1, 0, 0, true)
+	footer := tview.NewGrid().SetRows(1)
+	if c.role == message.RStreamerChat {
+		footer.SetColumns(3, 0).
+			AddItem(c.muteBtn, 0, 0, 1, 1, 0, 0, false).
+			AddItem(messageInput, 0, 1, 1, 1, 0, 0, true)
+	} else {
+		// voice chat is for streamers only
+		footer.SetColumns(0).
+			AddItem(messageInput, 0, 0, 1, 1, 0, 0, true)
+	}
 
 	layout.AddItem(header, 0, 0, 1, 1, 0, 0, false).
 		AddItem(c.chatTextView, 1, 0, 1, 1, 0, 0, false).
@@ -497,18 +553,23 @@ func (c *Chat) initUI() error {
 		return event
 
 	})
-	c.app.SetRoot(layout, true)
-	return nil
+	return layout
 }
 
 func (c *Chat) HandleCommand(command string) error {
 	args := strings.Split(command, " ")
+	if c.role != message.RStreamerChat {
+		return c.handleViewerCommand(args)
+	}
+
 	switch args[0] {
 	case "help":
 		c.addNoti(`TStream - Streaming from terimnal
       [green]/title[yellow] title[white] - to change stream title 
       [green]/mute[white] - to turn on microphone
       [green]/unmute[white] - to turn off microphone
+      [green]/control[yellow] name[white] - to let a viewer type into your terminal
+      [green]/revoke[yellow] name[white] - to take back control. Leave name empty to revoke everyone
       [green]/exit[white] - to exit chat room
       `)
 
@@ -530,6 +591,20 @@ func (c *Chat) HandleCommand(command string) error {
 			c.addNoti(`[yellow]/title : no title found[white]`)
 		}
 
+	case "control":
+		if len(args) > 1 {
+			c.setControl(args[1], true)
+		} else {
+			c.addNoti(`[yellow]/control : no name found[white]`)
+		}
+
+	case "revoke":
+		if len(args) > 1 {
+			c.setControl(args[1], false)
+		} else {
+			c.revokeAll()
+		}
+
 	case "mute":
 		c.toggleMute(true)
 
@@ -546,12 +621,28 @@ func (c *Chat) HandleCommand(command string) error {
 	return nil
 }
 
+func (c *Chat) handleViewerCommand(args []string) error {
+	switch args[0] {
+	case "help":
+		c.addNoti(`TStream - Streaming from terimnal
+      [green]/exit[white] - to exit room
+      `)
+
+	case "exit":
+		c.Stop("Bye!")
+
+	default:
+		c.addNoti(`Unknown command. Type /help to get list of available commands.`)
+	}
+	return nil
+}
+
 func (c *Chat) ConnctWSVoice() error {
 	return nil
 }
 
 func (c *Chat) connectWS(role message.CRole) (*websocket.Conn, error) {
-	url := getWSUrl(c.serverAddr, c.username)
+	url := getWSUrl(c.serverAddr, c.sessionId)
 
 	log.Printf("Openning socket at %s", url)
 
@@ -567,24 +658,9 @@ func (c *Chat) connectWS(role message.CRole) (*websocket.Conn, error) {
 		Secret: GetSecret(CONFIG_PATH),
 	}
 
-	payload := message.Wrapper{Type: message.TClientInfo, Data: clientInfo}
-	err = conn.WriteJSON(payload)
-	if err != nil {
-		return conn, fmt.Errorf("Failed to connect to server")
-	}
-
-	// Verify server's response
-	msg := message.Wrapper{}
-	err = conn.ReadJSON(&msg)
-	if err != nil {
-		log.Printf("Failed to read websocket message: %s", err)
-		return conn, fmt.Errorf("Failed to read websocket message: %s", err)
-	}
-
-	if msg.Type == message.TUnauthorized {
-		return conn, fmt.Errorf("Unauthorized connection")
-	} else if msg.Type != message.TAuthorized {
-		return conn, fmt.Errorf("Expect connect confirmation from server")
+	if _, err := handshake(conn, clientInfo, true); err != nil {
+		log.Printf("Failed to connect to server: %s", err)
+		return conn, err
 	}
 
 	conn.SetPingHandler(func(appData string) error {
@@ -634,6 +710,64 @@ func (c *Chat) addNoti(msg string) {
 	c.chatTextView.SetText(currentChat + msg)
 }
 
+// Viewers are granted control by their client ID, which comes with their chats
+func (c *Chat) addViewers(chatList []message.Chat) {
+	c.viewersLock.Lock()
+	defer c.viewersLock.Unlock()
+	for _, chat := range chatList {
+		if chat.ID != "" && chat.Name != "" {
+			c.viewers[chat.Name] = chat.ID
+		}
+	}
+}
+
+func (c *Chat) setControl(name string, granted bool) {
+	c.viewersLock.Lock()
+	ID, ok := c.viewers[name]
+	c.viewersLock.Unlock()
+	if !ok {
+		c.addNoti(fmt.Sprintf(`[yellow]%s hasn't chatted in this room[white]`, name))
+		return
+	}
+	c.sendControl(message.Control{ID: ID, Granted: granted})
+}
+
+func (c *Chat) revokeAll() {
+	c.sendControl(message.Control{Granted: false})
+}
+
+func (c *Chat) sendControl(control message.Control) {
+	payload := message.Wrapper{Type: message.TControl, Data: control}
+	if err := c.wsConn.WriteJSON(payload); err != nil {
+		log.Printf("Failed to set control: %s", err)
+		c.addNoti(`[red]Failed to set control. Please try again[white]`)
+	}
+}
+
+// Notify who gained or lost control of streamer's shell
+func (c *Chat) updateCollaborators(collaborators []string) {
+	for _, name := range collaborators {
+		if !contains(c.collaborators, name) {
+			c.addNoti(fmt.Sprintf("[yellow]⌨ %s has control of the terminal[white]", name))
+		}
+	}
+	for _, name := range c.collaborators {
+		if !contains(collaborators, name) {
+			c.addNoti(fmt.Sprintf("[yellow]⌨ %s no longer has control of the terminal[white]", name))
+		}
+	}
+	c.collaborators = collaborators
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Chat) addChatMsgs(chatList []message.Chat) {
 	if len(chatList) == 0 {
 		return
@@ -670,6 +804,10 @@ func FormatChat(name, content, color string) string {
 	if content[len(content)-1] != '\n' {
 		content += "\n"
 	}
+	// notifications from server have no sender
+	if name == "" {
+		return fmt.Sprintf("[yellow]%s[white]", content)
+	}
 	return fmt.Sprintf("[%s]%s[white]: %s", color, name, content)
 }
 
@@ -683,3 +821,53 @@ func getWSUrl(serverAddr, username string) string {
 	url := url.URL{Scheme: scheme, Host: host, Path: fmt.Sprintf("/ws/%s", username)}
 	return url.String()
 }
+
+// Send client info and wait for server to reply the negotiated protocol, then whether client is authorized
+// Server replies with an error if it can't serve the client
+// Servers before protocol versions reply with authorization only, they speak version 1
+func handshake(conn *websocket.Conn, clientInfo message.ClientInfo, authorize bool) (message.Protocol, error) {
+	protocol := message.Protocol{Version: 1}
+	clientInfo.ProtocolVersion = cfg.PROTOCOL_VERSION
+	if err := conn.WriteJSON(message.Wrapper{Type: message.TClientInfo, Data: clientInfo}); err != nil {
+		return protocol, fmt.Errorf("Failed to connect to server")
+	}
+
+	read := func() (message.Wrapper, error) {
+		msg := message.Wrapper{}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		defer conn.SetReadDeadline(time.Time{})
+		if err := conn.ReadJSON(&msg); err != nil {
+			return msg, fmt.Errorf("Failed to read websocket message: %s", err)
+		}
+		return msg, nil
+	}
+
+	msg, err := read()
+	if err != nil {
+		return protocol, err
+	}
+	if msg.Type == message.TProtocol {
+		if err := message.ToStruct(msg.Data, &protocol); err != nil || !authorize {
+			return protocol, err
+		}
+		if msg, err = read(); err != nil {
+			return protocol, err
+		}
+	}
+
+	switch msg.Type {
+	case message.TAuthorized:
+		return protocol, nil
+
+	case message.TUnauthorized:
+		return protocol, errUnauthorized
+
+	case message.TError:
+		serverErr := message.Error{}
+		message.ToStruct(msg.Data, &serverErr)
+		return protocol, fmt.Errorf("%s", serverErr.Message)
+
+	default:
+		return protocol, fmt.Errorf("Expect connect confirmation from server, got: %s", msg.Type)
+	}
+}
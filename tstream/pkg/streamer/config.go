@@ -13,6 +13,11 @@ var CONFIG_PATH = os.ExpandEnv("$HOME/.tstream.conf")
 type Config struct {
 	Secret   string `json:"secret"`
 	Username string `json:"username"`
+	// extra patterns to mask in stream, besides DEFAULT_REDACT_PATTERNS
+	Redact []string `json:"redact,omitempty"`
+	// stream delay and block duration, in milliseconds
+	Delay         uint64 `json:"delay,omitempty"`
+	BlockDuration uint64 `json:"blockDuration,omitempty"`
 }
 
 func NewCfg() Config {
@@ -61,17 +66,13 @@ func UpdateCfg(path, key string, value string) (Config, error) {
 
 func GetSecret(configPath string) string {
 	cfg, err := ReadCfg(CONFIG_PATH)
-	var secret string
 
 	// gen a new one if not existed
 	if err != nil || cfg.Secret == "" {
-		cfg = NewCfg()
 		cfg.Secret = GenSecret("tstream")
 		WriteCfg(CONFIG_PATH, cfg)
-	} else {
-		secret = cfg.Secret
 	}
-	return secret
+	return cfg.Secret
 }
 
 func GenSecret(key string) string {
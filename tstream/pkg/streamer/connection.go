@@ -0,0 +1,352 @@
+/*
+Keep the connection with server alive.
+Messages are queued while streamer is offline and sent once it reconnects, the pty keeps running meanwhile
+*/
+package streamer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+type queuedMsg struct {
+	msgType message.MType
+	data    []byte
+}
+
+// Messages waiting to be sent to server
+// Oldest messages are dropped once the queue is larger than size
+type sendQueue struct {
+	lock    sync.Mutex
+	msgs    []queuedMsg
+	bytes   int
+	size    int
+	dropped bool
+	// signaled when a message is pushed
+	notify chan struct{}
+}
+
+func newSendQueue(size int) *sendQueue {
+	return &sendQueue{
+		size:   size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (q *sendQueue) Push(msg message.Wrapper) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	q.msgs = append(q.msgs, queuedMsg{msgType: msg.Type, data: data})
+	q.bytes += len(data)
+	for q.bytes > q.size && len(q.msgs) > 1 {
+		q.bytes -= len(q.msgs[0].data)
+		q.msgs = q.msgs[1:]
+		q.dropped = true
+	}
+	q.lock.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// First message in queue, it stays in queue until Pop
+func (q *sendQueue) Peek() (queuedMsg, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.msgs) == 0 {
+		return queuedMsg{}, false
+	}
+	return q.msgs[0], true
+}
+
+func (q *sendQueue) Pop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.msgs) == 0 {
+		return
+	}
+	q.bytes -= len(q.msgs[0].data)
+	q.msgs = q.msgs[1:]
+}
+
+// Remove all messages. Return whether any message was dropped since the last reset
+func (q *sendQueue) Reset() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	dropped := q.dropped
+	q.msgs = nil
+	q.bytes = 0
+	q.dropped = false
+	return dropped
+}
+
+func (q *sendQueue) Dropped() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+func (s *Streamer) wsConn() *websocket.Conn {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return s.conn
+}
+
+// Send queued messages to server. Reconnect whenever the connection is lost
+func (s *Streamer) connLoop() {
+	broken := s.readLoop(s.wsConn())
+	for {
+		select {
+		case <-s.queue.notify:
+		case <-broken:
+			if !s.reconnect() {
+				return
+			}
+			broken = s.readLoop(s.wsConn())
+		case <-s.done:
+			return
+		}
+		s.flushQueue()
+	}
+}
+
+// Read and handle messages from server
+// The returned channel is closed once the connection is broken
+func (s *Streamer) readLoop(conn *websocket.Conn) <-chan struct{} {
+	broken := make(chan struct{})
+	go func() {
+		defer close(broken)
+		for {
+			msg := message.Wrapper{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				log.Printf("Failed to receive message from server: %s", err)
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(cfg.STREAMER_PING_TIMEOUT * time.Second))
+			s.handleServerMessage(msg)
+		}
+	}()
+	return broken
+}
+
+// Send messages in queue until it's empty or the connection is broken
+func (s *Streamer) flushQueue() {
+	conn := s.wsConn()
+	for {
+		msg, ok := s.queue.Peek()
+		if !ok {
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(cfg.STREAMER_WRITE_TIMEOUT * time.Second))
+		if err := conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+			// read loop fails too and triggers a reconnect
+			log.Printf("Failed to send message: %s", err)
+			conn.Close()
+			return
+		}
+		s.queue.Pop()
+
+		if msg.msgType == message.TClose {
+			close(s.closeSent)
+		}
+	}
+}
+
+// Reconnect with exponential backoff until it succeeds. Return false if streamer is stopped
+func (s *Streamer) reconnect() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	log.Printf("Lost connection to server, reconnecting")
+	s.stdout.SetTitle("⚠️  tstream: lost connection to server, reconnecting...")
+	backoff := cfg.STREAMER_RECONNECT_MIN * time.Second
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return false
+		}
+
+		log.Printf("Reconnecting...")
+		// Server removes rooms that are idle for too long
+		statusCode, err := s.RequestAddRoom(false)
+		switch {
+		case err != nil:
+		case statusCode == 400:
+			s.Stop("Another terminal took over the session")
+			return false
+		case statusCode == 401:
+			s.Stop(fmt.Sprintf("Username: %s is currently used by other streamer", s.username))
+			return false
+		case statusCode != 200:
+			err = fmt.Errorf("Server replied with status %d", statusCode)
+		default:
+			err = s.ConnectWS()
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to reconnect: %s. Retry in %s", err, backoff)
+
+		backoff *= 2
+		if backoff > cfg.STREAMER_RECONNECT_MAX*time.Second {
+			backoff = cfg.STREAMER_RECONNECT_MAX * time.Second
+		}
+	}
+
+	// Queued messages are incomplete, viewers get the current screen instead
+	if s.queue.Dropped() {
+		s.queue.Reset()
+		s.writeSnapshot()
+	}
+	log.Printf("Reconnected")
+	s.stdout.RestoreTitle()
+	return true
+}
+
+// States of the terminal parser, escape sequences start with ESC
+const (
+	termGround = iota
+	termEscape
+	termCSI
+	termString // OSC, DCS... ended by BEL or ESC \
+	termStringEscape
+)
+
+// Local terminal of streamer, it shows connection status in the title.
+// Output written to it can stop in the middle of an escape sequence or a character,
+// the title waits until the output stops in between so it doesn't break either
+type termWriter struct {
+	lock     sync.Mutex
+	w        io.Writer
+	state    int
+	runeLeft int // bytes left of a UTF-8 character
+	titled   bool
+	pending  []byte
+}
+
+func newTermWriter(w io.Writer) *termWriter {
+	return &termWriter{w: w}
+}
+
+func (t *termWriter) Write(data []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n, err := t.w.Write(data)
+	for _, b := range data[:n] {
+		t.scan(b)
+	}
+	t.flush()
+	return n, err
+}
+
+// Show title instead of the one set by programs of streamer, until RestoreTitle
+func (t *termWriter) SetTitle(title string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// keep the title of streamer on the title stack of terminal
+	if !t.titled {
+		t.pending = append(t.pending, "\x1b[22;0t"...)
+		t.titled = true
+	}
+	t.pending = append(t.pending, "\x1b]0;"+title+"\x07"...)
+	t.flush()
+}
+
+func (t *termWriter) RestoreTitle() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.titled {
+		return
+	}
+	t.pending = append(t.pending, "\x1b[23;0t"...)
+	t.titled = false
+	t.flush()
+}
+
+// Write pending title if output stopped in between escape sequences and characters
+func (t *termWriter) flush() {
+	if len(t.pending) == 0 || t.state != termGround || t.runeLeft > 0 {
+		return
+	}
+	if _, err := t.w.Write(t.pending); err != nil {
+		log.Printf("Failed to set title: %s", err)
+	}
+	t.pending = nil
+}
+
+func (t *termWriter) scan(b byte) {
+	switch t.state {
+	case termGround:
+		switch {
+		case b == ESC:
+			t.state = termEscape
+			t.runeLeft = 0
+		case b >= 0xf0 && b < 0xf8:
+			t.runeLeft = 3
+		case b >= 0xe0 && b < 0xf0:
+			t.runeLeft = 2
+		case b >= 0xc0 && b < 0xe0:
+			t.runeLeft = 1
+		case b >= 0x80 && b < 0xc0 && t.runeLeft > 0:
+			t.runeLeft--
+		default:
+			t.runeLeft = 0
+		}
+
+	case termEscape:
+		switch {
+		case b == '[':
+			t.state = termCSI
+		case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+			t.state = termString
+		case b >= 0x20 && b <= 0x2f: // intermediate bytes
+		default:
+			t.state = termGround
+		}
+
+	case termCSI:
+		// parameters and intermediates are 0x20-0x3f, then a final byte
+		if b == ESC {
+			t.state = termEscape
+		} else if b > 0x3f {
+			t.state = termGround
+		}
+
+	case termString:
+		if b == 0x07 {
+			t.state = termGround
+		} else if b == ESC {
+			t.state = termStringEscape
+		}
+
+	case termStringEscape:
+		if b == '\\' {
+			t.state = termGround
+		} else {
+			// the string is cancelled by another escape sequence
+			t.state = termEscape
+			t.scan(b)
+		}
+	}
+}
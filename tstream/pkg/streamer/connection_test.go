@@ -0,0 +1,230 @@
+package streamer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Server that accepts streamer and lets tests drop the connection
+type fakeServer struct {
+	url      string
+	status   int32                // replied to add room requests
+	attempts chan time.Time       // when streamer asked to add room
+	conns    chan *websocket.Conn // accepted streamer connections
+	msgs     chan message.Wrapper // received from streamer
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	log.SetOutput(ioutil.Discard)
+	srv := &fakeServer{
+		status:   200,
+		attempts: make(chan time.Time, 16),
+		conns:    make(chan *websocket.Conn, 16),
+		msgs:     make(chan message.Wrapper, 256),
+	}
+
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/room", func(w http.ResponseWriter, r *http.Request) {
+		srv.attempts <- time.Now()
+		w.WriteHeader(int(atomic.LoadInt32(&srv.status)))
+	})
+	mux.HandleFunc("/ws/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		msg := message.Wrapper{}
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != message.TClientInfo {
+			t.Errorf("Got %s: %v, want client info", msg.Type, err)
+			conn.Close()
+			return
+		}
+		conn.WriteJSON(message.Wrapper{Type: message.TAuthorized})
+		srv.conns <- conn
+		for {
+			msg := message.Wrapper{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			srv.msgs <- msg
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	srv.url = server.URL
+	return srv
+}
+
+func (srv *fakeServer) setStatus(status int) {
+	atomic.StoreInt32(&srv.status, int32(status))
+}
+
+// Drop the connection of streamer without telling it
+func (srv *fakeServer) drop(t *testing.T) {
+	t.Helper()
+	select {
+	case conn := <-srv.conns:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Streamer isn't connected")
+	}
+}
+
+// Read messages from streamer until one of msgType
+func (srv *fakeServer) waitFor(t *testing.T, msgType message.MType) message.Wrapper {
+	t.Helper()
+	for {
+		select {
+		case msg := <-srv.msgs:
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Didn't get %s", msgType)
+		}
+	}
+}
+
+// Streamer in direct mode connected to srv, without a pty
+func connectStreamer(t *testing.T, srv *fakeServer, queueSize int) *Streamer {
+	s := newTestStreamer()
+	s.serverAddr = srv.url
+	s.queue = newSendQueue(queueSize)
+	if err := s.ConnectWS(); err != nil {
+		t.Fatal(err)
+	}
+	s.sending.Add(1)
+	go s.sendLoop()
+	t.Cleanup(func() { s.Stop("") })
+	return s
+}
+
+func writeData(t *testing.T, msg message.Wrapper) string {
+	t.Helper()
+	var data []byte
+	if err := message.ToStruct(msg.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReconnect(t *testing.T) {
+	srv := newFakeServer(t)
+	s := connectStreamer(t, srv, 1024*1024)
+
+	s.Write([]byte("before"))
+	if data := writeData(t, srv.waitFor(t, message.TWrite)); data != "before" {
+		t.Errorf("Got %q, want before", data)
+	}
+
+	// output is queued while server is down
+	srv.setStatus(503)
+	lost := time.Now()
+	srv.drop(t)
+	s.Write([]byte("offline"))
+
+	first := <-srv.attempts
+	srv.setStatus(200)
+	second := <-srv.attempts
+	if first.Sub(lost) < time.Second || second.Sub(first) < 2*time.Second {
+		t.Errorf("Retried after %s then %s, want the wait doubled from 1s", first.Sub(lost), second.Sub(first))
+	}
+
+	// queued output is sent once reconnected, before anything new
+	s.Write([]byte("after"))
+	for _, want := range []string{"offline", "after"} {
+		if data := writeData(t, srv.waitFor(t, message.TWrite)); data != want {
+			t.Errorf("Got %q, want %q", data, want)
+		}
+	}
+}
+
+func TestReconnectDropped(t *testing.T) {
+	srv := newFakeServer(t)
+	s := connectStreamer(t, srv, 64)
+
+	srv.drop(t)
+	for i := 0; i < 10; i++ {
+		s.Write([]byte("a line longer than the queue is kept while offline\r\n"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// viewers get the screen instead of output with a gap
+	select {
+	case msg := <-srv.msgs:
+		if msg.Type != message.TSnapshot {
+			t.Errorf("Got %s, want a snapshot first", msg.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't reconnect")
+	}
+}
+
+func TestReconnectRefused(t *testing.T) {
+	for _, status := range []int{400, 401} {
+		srv := newFakeServer(t)
+		s := connectStreamer(t, srv, 1024*1024)
+
+		// another terminal took over or someone else has the username
+		srv.setStatus(status)
+		srv.drop(t)
+		select {
+		case <-s.done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Streamer keeps reconnecting after %d", status)
+		}
+		select {
+		case <-srv.conns:
+			t.Errorf("Streamer reconnected after %d", status)
+		default:
+		}
+	}
+}
+
+func TestTermWriterTitle(t *testing.T) {
+	title := "\x1b[22;0t\x1b]0;offline\x07"
+	tests := []struct {
+		name   string
+		before string // written before title is set
+		after  string // written after
+		want   string
+	}{
+		{"ground", "text", "more", "text" + title + "more"},
+		{"in CSI", "\x1b[3", "1mred", "\x1b[31mred" + title},
+		{"in OSC", "\x1b]0;vim", "\x1b\\", "\x1b]0;vim\x1b\\" + title},
+		{"in character", "caf\xc3", "\xa9", "caf\xc3\xa9" + title},
+		{"after escape", "\x1b[0m", "", "\x1b[0m" + title},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		w := newTermWriter(&out)
+		w.Write([]byte(tt.before))
+		w.SetTitle("offline")
+		w.Write([]byte(tt.after))
+		if got := out.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// title of streamer is restored once
+	var out bytes.Buffer
+	w := newTermWriter(&out)
+	w.SetTitle("offline")
+	w.SetTitle("still offline")
+	w.RestoreTitle()
+	w.RestoreTitle()
+	if want := title + "\x1b]0;still offline\x07\x1b[23;0t"; out.String() != want {
+		t.Errorf("Got %q, want %q", out.String(), want)
+	}
+}
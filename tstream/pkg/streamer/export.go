@@ -0,0 +1,27 @@
+package streamer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Download a recorded session from server in the given format
+func Export(serverAddr string, roomID uint64, format string, w io.Writer) error {
+	queries := url.Values{"format": {format}}
+	resp, err := http.Get(fmt.Sprintf("%s/api/room/%d/export?%s", serverAddr, roomID, queries.Encode()))
+	if err != nil {
+		return fmt.Errorf("Failed to connect to server: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Failed to export room %d: %s", roomID, msg)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
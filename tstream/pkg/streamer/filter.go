@@ -0,0 +1,102 @@
+/*
+Filters rewrite terminal output before it's streamed.
+The local terminal always shows the original output
+*/
+package streamer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// hold an unfinished line for at most this long before streaming it
+const FILTER_FLUSH_AFTER = 100 * time.Millisecond
+
+// stream a long line without waiting for its end once it grows over this size
+const FILTER_MAX_PENDING = 4096
+
+// Longest secret that is still masked when it's split between 2 writes to stream
+const FILTER_MAX_SECRET = 256
+
+// A Filter returns data to stream in place of data
+// The result has the same length, so it can be streamed in parts
+type Filter func(data []byte) []byte
+
+// Apply filters to output before writing it to out
+// Output is passed to filters in whole lines when possible, so a match isn't
+// split between 2 reads of pty. Filters also see the tail of what was written
+// before, so a match that is split anyway is still found
+type filterWriter struct {
+	lock    sync.Mutex
+	out     io.Writer
+	filters []Filter
+	pending []byte
+	written []byte // tail of output already written, at most FILTER_MAX_SECRET bytes
+	timer   *time.Timer
+}
+
+func newFilterWriter(out io.Writer, filters []Filter) *filterWriter {
+	w := &filterWriter{
+		out:     out,
+		filters: filters,
+	}
+	w.timer = time.AfterFunc(FILTER_FLUSH_AFTER, func() { w.Flush() })
+	w.timer.Stop()
+	return w
+}
+
+func (w *filterWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.pending = append(w.pending, data...)
+	end := bytes.LastIndexByte(w.pending, '\n') + 1
+	if len(w.pending) > FILTER_MAX_PENDING {
+		// hold back the tail in case it's the start of a secret
+		end = len(w.pending) - FILTER_MAX_SECRET
+	}
+
+	if end > 0 {
+		if err := w.write(end); err != nil {
+			return 0, err
+		}
+	}
+
+	// prompts and the line being typed don't end with a newline
+	if len(w.pending) > 0 {
+		w.timer.Reset(FILTER_FLUSH_AFTER)
+	}
+	return len(data), nil
+}
+
+// Write what's held back
+func (w *filterWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.pending) == 0 {
+		return nil
+	}
+	return w.write(len(w.pending))
+}
+
+// Write the first n bytes of pending, filtered along with the tail written before
+// and the rest of pending after them
+func (w *filterWriter) write(n int) error {
+	filtered := append(append([]byte{}, w.written...), w.pending...)
+	for _, filter := range w.filters {
+		filtered = filter(filtered)
+	}
+	data := filtered[len(w.written) : len(w.written)+n]
+
+	w.written = append(w.written, w.pending[:n]...)
+	if len(w.written) > FILTER_MAX_SECRET {
+		w.written = append([]byte{}, w.written[len(w.written)-FILTER_MAX_SECRET:]...)
+	}
+	w.pending = w.pending[n:]
+
+	_, err := w.out.Write(data)
+	return err
+}
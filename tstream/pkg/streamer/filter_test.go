@@ -0,0 +1,82 @@
+package streamer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Output of the default redactor written in chunks of size
+func filterInChunks(t *testing.T, data []byte, size int) []byte {
+	t.Helper()
+	redactor, err := NewRedactor(DEFAULT_REDACT_PATTERNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	w := newFilterWriter(&out, []Filter{redactor})
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	w.Flush()
+	return out.Bytes()
+}
+
+func TestFilterChunks(t *testing.T) {
+	token := "ghp_" + strings.Repeat("a", 36)
+	redactor, _ := NewRedactor(DEFAULT_REDACT_PATTERNS)
+
+	// lines longer than FILTER_MAX_PENDING are cut, secrets around the cut are still masked
+	for _, offset := range []int{0, FILTER_MAX_PENDING - FILTER_MAX_SECRET - 20, FILTER_MAX_PENDING - 20, FILTER_MAX_PENDING + 10, 3 * FILTER_MAX_PENDING} {
+		line := strings.Repeat("x", offset) + " " + token + " password=\x1b[1mhunter2\x1b[0m " + strings.Repeat("y", FILTER_MAX_PENDING) + "\r\n"
+		data := []byte(line + line)
+		want := redactor(append([]byte{}, data...))
+		if bytes.Contains(want, []byte(token)) || bytes.Contains(want, []byte("hunter2")) {
+			t.Fatal("Secrets aren't masked")
+		}
+
+		for _, size := range []int{1, 7, 100, FILTER_MAX_PENDING + 1, len(data)} {
+			if got := filterInChunks(t, data, size); !bytes.Equal(got, want) {
+				t.Errorf("Token at %d written in chunks of %d: got %d bytes different from expected", offset, size, len(got))
+			}
+		}
+	}
+}
+
+func TestFilterPrompt(t *testing.T) {
+	redactor, _ := NewRedactor(DEFAULT_REDACT_PATTERNS)
+	var out bytes.Buffer
+	w := newFilterWriter(&out, []Filter{redactor})
+
+	// a line being typed is streamed before it ends
+	w.Write([]byte("$ password=abc"))
+	time.Sleep(3 * FILTER_FLUSH_AFTER)
+	w.lock.Lock()
+	if got := out.String(); got != "$ password=***" {
+		t.Errorf("Got %q before the line ends", got)
+	}
+	w.lock.Unlock()
+
+	// rest of the secret is masked with what's already streamed
+	w.Write([]byte("def\r\n"))
+	if got := out.String(); got != "$ password=******\r\n" {
+		t.Errorf("Got %q after the line ends", got)
+	}
+}
+
+func TestFilterNone(t *testing.T) {
+	var out bytes.Buffer
+	w := newFilterWriter(&out, nil)
+	w.Write([]byte("password=abc\r\n\x1b[0m"))
+	w.Flush()
+	if got := out.String(); got != "password=abc\r\n\x1b[0m" {
+		t.Errorf("Got %q without filters", got)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Pause streaming to step away or do something private.
+Output is still shown in the local terminal, viewers see an away screen until resume
+*/
+package streamer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+const (
+	PAUSE_SIGNAL  = syscall.SIGUSR1
+	RESUME_SIGNAL = syscall.SIGUSR2
+)
+
+func (s *Streamer) Paused() bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	return s.paused
+}
+
+// Stop sending output to viewers
+func (s *Streamer) Pause() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if s.paused {
+		return
+	}
+
+	s.paused = true
+	s.recorder.WriteMsg(message.Wrapper{
+		Type: message.TPause,
+		Data: message.Pause{Paused: true},
+	})
+}
+
+// Continue sending output to viewers
+// The screen could have changed while paused, so viewers get a fresh one first
+func (s *Streamer) Resume() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if !s.paused {
+		return
+	}
+
+	s.paused = false
+	s.recorder.WriteMsg(message.Wrapper{
+		Type: message.TSnapshot,
+		Data: s.emulator.Snapshot(),
+	})
+	s.recorder.WriteMsg(message.Wrapper{
+		Type: message.TPause,
+		Data: message.Pause{Paused: false},
+	})
+}
+
+// Pause and resume when signaled by `tstream pause` and `tstream resume`
+func (s *Streamer) pauseLoop() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, PAUSE_SIGNAL, RESUME_SIGNAL)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == PAUSE_SIGNAL {
+				s.Pause()
+			} else {
+				s.Resume()
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Pause or resume the session this process runs in
+func SignalPause(pause bool) error {
+	env := os.Getenv(cfg.STREAMER_ENVKEY_PID)
+	if env == "" {
+		env = tmuxPid()
+	}
+	pid, err := strconv.Atoi(env)
+	if err != nil {
+		return fmt.Errorf("This terminal is not streaming")
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	sig := RESUME_SIGNAL
+	if pause {
+		sig = PAUSE_SIGNAL
+	}
+	if err := process.Signal(sig); err != nil {
+		log.Printf("Failed to signal streamer %d: %s", pid, err)
+		return fmt.Errorf("Failed to reach the streaming session")
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+/*
+Play a recorded terminal session as a stream.
+Used to host demos: each frame of an asciicast or ttyrec file is fed to the recorder
+so viewers receive exactly the same blocks as a live session
+*/
+package streamer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/asciicast"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/ttyrec"
+)
+
+const (
+	FAsciicast = "asciicast"
+	FTtyrec    = "ttyrec"
+)
+
+// pause between two plays when playing in loop
+const PLAYER_LOOP_PAUSE = 3 * time.Second
+
+type Frame struct {
+	Time    time.Duration // offset since the start of the session
+	Data    []byte        // output written to terminal
+	Winsize *message.Winsize
+}
+
+type Playable interface {
+	// Return io.EOF when there is no frame left
+	Next() (Frame, error)
+	Close() error
+}
+
+// Open a recorded session file
+// format is detected by file extension if it's empty
+// winsize is used for formats that don't store terminal size
+func OpenPlayable(path, format string, winsize message.Winsize) (Playable, error) {
+	if format == "" {
+		if filepath.Ext(path) == ".cast" {
+			format = FAsciicast
+		} else {
+			format = FTtyrec
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FAsciicast:
+		r, err := asciicast.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to read asciicast file: %s", err)
+		}
+		header := r.Header()
+		return &castPlayable{
+			f:       f,
+			r:       r,
+			winsize: &message.Winsize{Cols: uint16(header.Width), Rows: uint16(header.Height)},
+		}, nil
+
+	case FTtyrec:
+		return &ttyrecPlayable{
+			f:       f,
+			r:       ttyrec.NewReader(f),
+			winsize: &winsize,
+		}, nil
+
+	default:
+		f.Close()
+		return nil, fmt.Errorf("Unsupported format: %s", format)
+	}
+}
+
+type castPlayable struct {
+	f       *os.File
+	r       *asciicast.Reader
+	winsize *message.Winsize // initial winsize, sent with the first frame
+}
+
+func (p *castPlayable) Next() (Frame, error) {
+	if p.winsize != nil {
+		frame := Frame{Winsize: p.winsize}
+		p.winsize = nil
+		return frame, nil
+	}
+
+	for {
+		e, err := p.r.Next()
+		if err != nil {
+			return Frame{}, err
+		}
+
+		frame := Frame{Time: time.Duration(e.Time * float64(time.Second))}
+		switch e.Type {
+		case asciicast.EOutput:
+			frame.Data = []byte(e.Data)
+			return frame, nil
+
+		case asciicast.EResize:
+			cols, rows, err := asciicast.ParseResizeData(e.Data)
+			if err != nil {
+				log.Printf("Invalid resize event: %s", e.Data)
+				continue
+			}
+			frame.Winsize = &message.Winsize{Cols: cols, Rows: rows}
+			return frame, nil
+		}
+		// input and marker events are not shown to viewers
+	}
+}
+
+func (p *castPlayable) Close() error {
+	return p.f.Close()
+}
+
+type ttyrecPlayable struct {
+	f         *os.File
+	r         *ttyrec.Reader
+	startTime time.Time
+	winsize   *message.Winsize // initial winsize, sent with the first frame
+}
+
+func (p *ttyrecPlayable) Next() (Frame, error) {
+	if p.winsize != nil {
+		frame := Frame{Winsize: p.winsize}
+		p.winsize = nil
+		return frame, nil
+	}
+
+	ttyFrame, err := p.r.Next()
+	if err != nil {
+		return Frame{}, err
+	}
+	if p.startTime.IsZero() {
+		p.startTime = ttyFrame.Time
+	}
+	return Frame{Time: ttyFrame.Time.Sub(p.startTime), Data: ttyFrame.Data}, nil
+}
+
+func (p *ttyrecPlayable) Close() error {
+	return p.f.Close()
+}
+
+// Stream a recorded session file instead of a shell. Blocking until finished
+// Set loop to replay the file until streamer is stopped
+func (s *Streamer) Play(path, format string, winsize message.Winsize, loop bool) error {
+	// Make sure the file can be played before going live
+	playable, err := OpenPlayable(path, format, winsize)
+	if err != nil {
+		return err
+	}
+
+	if err := s.ConnectWS(); err != nil {
+		playable.Close()
+		log.Println(err)
+		return err
+	}
+
+	s.recorder = NewRecorder(s.blockDuration, s.delay, s.Out)
+	go s.recorder.Start()
+	s.sending.Add(1)
+	go s.sendLoop()
+	go s.snapshotLoop()
+
+	s.printStreamingAddr()
+
+	for {
+		err = s.play(playable)
+		playable.Close()
+		if err != nil || !loop {
+			break
+		}
+
+		select {
+		case <-time.After(PLAYER_LOOP_PAUSE):
+		case <-s.done:
+			return nil
+		}
+
+		// Start the next play on a clean screen
+		s.Write([]byte("\x1b[0m\x1b[H\x1b[2J"))
+		if playable, err = OpenPlayable(path, format, winsize); err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-s.done:
+		return err
+	default:
+	}
+
+	// wait for the last block to be sent
+	select {
+	case <-time.After(s.delay + s.blockDuration):
+	case <-s.done:
+	}
+
+	if err != nil {
+		s.Stop("")
+		return err
+	}
+	s.Stop("Finished playing!")
+	return nil
+}
+
+// Feed frames to recorder following their timing
+func (s *Streamer) play(playable Playable) error {
+	startTime := time.Now()
+	for {
+		frame, err := playable.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(time.Until(startTime.Add(frame.Time))):
+		case <-s.done:
+			return nil
+		}
+
+		if frame.Winsize != nil {
+			s.writeWinsize(frame.Winsize.Rows, frame.Winsize.Cols)
+		}
+		if len(frame.Data) > 0 {
+			s.Write(frame.Data)
+		}
+	}
+}
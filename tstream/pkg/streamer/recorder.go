@@ -2,13 +2,11 @@
 Recorder service for streamer.
 It receives package from pty and manage when to send to server
 Each message is a TermBlock. Inside termblock is multiple TermWrite message during a time interval
+In direct mode messages are sent right away instead, writes close together are merged into one
 ***/
 package streamer
 
 import (
-	"bytes"
-	"compress/gzip"
-	//"encoding/base64"
 	"encoding/json"
 	"github.com/qnkhuat/tstream/pkg/message"
 	"log"
@@ -29,6 +27,15 @@ type Recorder struct {
 	delay time.Duration
 
 	currentBlock *Block
+
+	// send messages right away instead of in blocks
+	direct bool
+	// merge writes within this duration into one message
+	coalesce time.Duration
+	pending  []byte
+	timer    *time.Timer
+	// held while sending in direct mode to keep messages in order, writes don't wait for it
+	sendLock sync.Mutex
 }
 
 func NewRecorder(blockDuration time.Duration, delay time.Duration, out chan<- message.Wrapper) *Recorder {
@@ -48,7 +55,24 @@ func NewRecorder(blockDuration time.Duration, delay time.Duration, out chan<- me
 	}
 }
 
+// Recorder for direct mode
+func NewDirectRecorder(coalesce time.Duration, out chan<- message.Wrapper) *Recorder {
+	r := &Recorder{
+		out:      out,
+		direct:   true,
+		coalesce: coalesce,
+	}
+	r.timer = time.AfterFunc(coalesce, r.Send)
+	r.timer.Stop()
+	return r
+}
+
 func (r *Recorder) Start() {
+	// direct mode has no blocks to send
+	if r.direct {
+		return
+	}
+
 	if r.out == nil {
 		log.Printf("No output channel for recorder")
 		return
@@ -66,6 +90,13 @@ func (r *Recorder) Start() {
 
 // send all message in block and create a new one
 func (r *Recorder) Send() {
+	if r.direct {
+		r.sendLock.Lock()
+		defer r.sendLock.Unlock()
+		r.flush()
+		return
+	}
+
 	if r.currentBlock.NQueue() == 0 {
 		r.newBlock()
 		return
@@ -83,6 +114,16 @@ func (r *Recorder) Send() {
 
 // used for TermWrite message only
 func (r *Recorder) Write(data []byte) (int, error) {
+	if r.direct {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if len(r.pending) == 0 {
+			r.timer.Reset(r.coalesce)
+		}
+		r.pending = append(r.pending, data...)
+		return len(data), nil
+	}
+
 	r.lock.Lock()
 	r.currentBlock.AddMsg(message.Wrapper{
 		Type: message.TWrite,
@@ -94,12 +135,38 @@ func (r *Recorder) Write(data []byte) (int, error) {
 
 // add any message
 func (r *Recorder) WriteMsg(msg message.Wrapper) {
+	if r.direct {
+		r.sendLock.Lock()
+		defer r.sendLock.Unlock()
+		// keep the order with writes
+		r.flush()
+		r.out <- msg
+		return
+	}
+
 	// used for TermWrite message only
 	r.lock.Lock()
 	r.currentBlock.AddMsg(msg)
 	r.lock.Unlock()
 }
 
+// send pending writes in direct mode. Caller must hold sendLock
+func (r *Recorder) flush() {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.timer.Stop()
+	r.lock.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	r.out <- message.Wrapper{
+		Type: message.TWrite,
+		Data: pending,
+	}
+}
+
 func (r *Recorder) newBlock() {
 	r.lock.Lock()
 	r.currentBlock = NewBlock(r.blockDuration, r.delay)
@@ -134,46 +201,14 @@ func NewBlock(duration time.Duration, delay time.Duration) *Block {
 }
 
 func (bl *Block) Serialize() (message.Wrapper, error) {
-	var msg message.Wrapper
-
-	// Serialize message queue
-	dataByte, err := json.Marshal(bl.queue)
-	if err != nil {
-		log.Printf("Failed to marshal message: %s", err)
-		return msg, err
-	}
-
-	// compress with gzip
-	// with gzip data often compressed to 1/10 -> 1/8 its original
-	// Note: 3 seconds of parrot generate 70Kb of raw bytes. With gzip the data is just 6k
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-	if _, err := gz.Write(dataByte); err != nil {
-		log.Printf("Failed to gzip: %s", err)
-		gz.Close()
-		return msg, err
-	}
-	gz.Close()
-
-	// construct return message
-	blockMsg := message.TermWriteBlock{
-		StartTime: bl.startTime,
-		Duration:  bl.duration.Milliseconds(),
-		Data:      b.Bytes(),
-	}
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
 
-	blockByte, err := json.Marshal(blockMsg)
+	msg, err := message.EncodeBlock(bl.queue, bl.startTime, bl.duration)
 	if err != nil {
-		log.Printf("Failed to encode termwrite block message")
-		return msg, err
-	}
-
-	msg = message.Wrapper{
-		Type: message.TWriteBlock,
-		Data: blockByte,
+		log.Printf("Failed to encode termwrite block message: %s", err)
 	}
-
-	return msg, nil
+	return msg, err
 }
 
 func (bl *Block) AddMsg(msg message.Wrapper) {
@@ -0,0 +1,46 @@
+package streamer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Direct recorder merges bursts of output and keeps other messages in order with it
+func TestDirectRecorder(t *testing.T) {
+	out := make(chan message.Wrapper, 16)
+	r := NewDirectRecorder(50*time.Millisecond, out)
+
+	r.Write([]byte("hel"))
+	r.Write([]byte("lo"))
+	r.WriteMsg(message.Wrapper{Type: message.TWinsize, Data: message.Winsize{Rows: 24, Cols: 80}})
+	r.Write([]byte(" world"))
+
+	next := func() message.Wrapper {
+		t.Helper()
+		select {
+		case msg := <-out:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("Recorder didn't send")
+		}
+		return message.Wrapper{}
+	}
+	if msg := next(); msg.Type != message.TWrite || writeData(t, msg) != "hello" {
+		t.Errorf("Got %s, want hello in one write", msg.Type)
+	}
+	if msg := next(); msg.Type != message.TWinsize {
+		t.Errorf("Got %s, want winsize after the output before it", msg.Type)
+	}
+
+	// the rest is sent once output stops for a while
+	if msg := next(); msg.Type != message.TWrite || writeData(t, msg) != " world" {
+		t.Errorf("Got %s, want the last write", msg.Type)
+	}
+	select {
+	case msg := <-out:
+		t.Errorf("Got extra %s", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
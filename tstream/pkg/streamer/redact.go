@@ -0,0 +1,140 @@
+/*
+Mask secrets in terminal output before it's streamed.
+Catch things like `cat .env` or `aws configure list` while streaming
+*/
+package streamer
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Patterns redacted by default. Add more with "redact" in config file
+// If a pattern has a group, only the first group is masked
+var DEFAULT_REDACT_PATTERNS = []string{
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,                                                 // AWS access key id
+	`(?i)aws_secret_access_key["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`,             // AWS secret key
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,                                                // Github token
+	`\bglpat-[A-Za-z0-9_-]{20,}\b`,                                                  // Gitlab token
+	`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`,                                              // Slack token
+	`\bsk-[A-Za-z0-9_-]{20,}\b`,                                                     // API keys of OpenAI, Stripe...
+	`(?i)(?:password|passwd|secret|token|api_?key)["']?\s*[=:]\s*["']?([^\s"',;]+)`, // password=...
+}
+
+const REDACT_MASK = '*'
+
+const ESC = 0x1b
+
+// Create a filter that masks matches of patterns
+func NewRedactor(patterns []string) (Filter, error) {
+	var regexps []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redact pattern %s: %s", pattern, err)
+		}
+		regexps = append(regexps, re)
+	}
+
+	return func(data []byte) []byte {
+		for _, re := range regexps {
+			data = redact(re, data)
+		}
+		return data
+	}, nil
+}
+
+// Filters of the stream from config, secrets are masked unless redact is off
+func ConfigFilters(config Config, redact bool) ([]Filter, error) {
+	if !redact {
+		return nil, nil
+	}
+	redactor, err := NewRedactor(append(append([]string{}, DEFAULT_REDACT_PATTERNS...), config.Redact...))
+	if err != nil {
+		return nil, err
+	}
+	return []Filter{redactor}, nil
+}
+
+// Mask printable characters matched by re, escape sequences and control characters are kept
+// so the screen of viewers isn't broken. Patterns match the text without escape sequences,
+// so a secret is still caught when it's colored
+// Each byte is masked so the length of data is kept
+func redact(re *regexp.Regexp, data []byte) []byte {
+	text, pos := visibleText(data)
+	matches := re.FindAllSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return data
+	}
+
+	out := append([]byte{}, data...)
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) >= 4 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+		for i := start; i < end; i++ {
+			if text[i] >= 0x20 && text[i] != 0x7f {
+				out[pos[i]] = REDACT_MASK
+			}
+		}
+	}
+	return out
+}
+
+// Text of data without escape sequences, and where each byte of it is in data
+// An unfinished escape sequence at the end of data isn't text either
+func visibleText(data []byte) ([]byte, []int) {
+	text := make([]byte, 0, len(data))
+	pos := make([]int, 0, len(data))
+	for i := 0; i < len(data); {
+		if data[i] == ESC {
+			i += escapeLen(data[i:])
+			continue
+		}
+		text = append(text, data[i])
+		pos = append(pos, i)
+		i++
+	}
+	return text, pos
+}
+
+// Length of the escape sequence data starts with
+func escapeLen(data []byte) int {
+	if len(data) < 2 {
+		return len(data)
+	}
+
+	switch data[1] {
+	case '[': // CSI: parameters, intermediates then a final byte
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7e {
+				return i + 1
+			}
+			if data[i] < 0x20 || data[i] > 0x3f {
+				// malformed, end it here
+				return i
+			}
+		}
+		return len(data)
+
+	case ']', 'P', 'X', '^', '_': // OSC, DCS...: string ended by BEL or ESC \
+		for i := 2; i < len(data); i++ {
+			if data[i] == 0x07 && data[1] == ']' {
+				return i + 1
+			}
+			if data[i] == ESC && i+1 < len(data) && data[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(data)
+
+	default: // intermediates then a final byte
+		for i := 1; i < len(data); i++ {
+			if data[i] < 0x20 || data[i] > 0x2f {
+				return i + 1
+			}
+		}
+		return len(data)
+	}
+}
@@ -0,0 +1,52 @@
+package streamer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	redactor, err := NewRedactor(DEFAULT_REDACT_PATTERNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := "ghp_" + strings.Repeat("a", 36)
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"no secret", "ls -la\r\n", "ls -la\r\n"},
+		{"token", "export GH=" + token + "\r\n", "export GH=" + strings.Repeat("*", 40) + "\r\n"},
+		{"only the group", "password=hunter2\r\n", "password=*******\r\n"},
+		{"escape after value", "password=hunter2\x1b[0m\r\n", "password=*******\x1b[0m\r\n"},
+		{"colored value", "token: \x1b[31mabc\x1b[0mdef\r\n", "token: \x1b[31m***\x1b[0m***\r\n"},
+		{"cursor moves", "password=ab\x1b[2Ccd\x1b[K", "password=**\x1b[2C**\x1b[K"},
+		{"title", "\x1b]0;password=hunter2\x07$ ", "\x1b]0;password=hunter2\x07$ "},
+		{"charset", "\x1b(Bpassword=x", "\x1b(Bpassword=*"},
+		{"unfinished escape", "password=abc\x1b[3", "password=***\x1b[3"},
+		{"keeps newlines", "password:\r\n  secret", "password:\r\n  ******"},
+	} {
+		if got := string(redactor([]byte(c.in))); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestConfigFilters(t *testing.T) {
+	if _, err := ConfigFilters(Config{Redact: []string{"("}}, true); err == nil {
+		t.Error("Got no error for an invalid pattern")
+	}
+
+	filters, err := ConfigFilters(Config{Redact: []string{`corp-[0-9]+`}}, true)
+	if err != nil || len(filters) != 1 {
+		t.Fatalf("Got %d filters: %v", len(filters), err)
+	}
+	if got := string(filters[0]([]byte("corp-123 password=x"))); got != "******** password=*" {
+		t.Errorf("Got %q, want the pattern of config and default ones masked", got)
+	}
+
+	// -no-redact streams output as is
+	if filters, err := ConfigFilters(Config{Redact: []string{`corp-[0-9]+`}}, false); err != nil || len(filters) != 0 {
+		t.Errorf("Got %d filters with redact off: %v", len(filters), err)
+	}
+}
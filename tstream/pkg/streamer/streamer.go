@@ -13,13 +13,17 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	ptyDevice "github.com/creack/pty"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/emulator"
 	"github.com/qnkhuat/tstream/pkg/message"
 	"github.com/qnkhuat/tstream/pkg/ptyMaster"
+	"github.com/qnkhuat/tstream/pkg/record"
 )
 
 type Streamer struct {
@@ -30,14 +34,48 @@ type Streamer struct {
 	secret     string
 	title      string
 	conn       *websocket.Conn
+	connLock   sync.Mutex
 	recorder   *Recorder
+	emulator   *emulator.Emulator // keep track of the screen to send snapshots
 	Out        chan message.Wrapper
 	In         chan message.Wrapper
 	// delay of sending message in queue
 	delay         time.Duration
 	blockDuration time.Duration
+	mode          message.StreamMode
 	private       bool
 	key           string // key to access if room is private
+
+	// keep a local copy of everything sent to server
+	localRecorder *record.Recorder
+	// stream to local recording only, it's uploaded after the session
+	offline bool
+	// program to stream instead of a shell, the session ends when it exits
+	command  []string
+	exitCode int
+	// tmux session streamed with AttachTmux
+	tmux *tmuxSession
+	// extra environment variables of the program
+	envVars []string
+	// rewrite output before it's streamed
+	filters []Filter
+	// output is shown locally only while paused
+	pauseLock sync.Mutex
+	paused    bool
+	// messages waiting to be sent, kept while streamer is offline
+	queue *sendQueue
+	// tells server a reconnect from a takeover by another terminal
+	session string
+	// local terminal, connection status is shown in its title
+	stdout *termWriter
+	// closed when the close message is sent to server
+	closeSent chan struct{}
+
+	// closed when streamer is stopped
+	done     chan struct{}
+	stopOnce sync.Once
+	// sendLoop is running
+	sending sync.WaitGroup
 }
 
 func New(clientAddr, serverAddr, username, title string) *Streamer {
@@ -50,15 +88,22 @@ func New(clientAddr, serverAddr, username, title string) *Streamer {
 	return &Streamer{
 		secret:     secret,
 		pty:        pty,
+		emulator:   emulator.New(emulator.DEFAULT_COLS, emulator.DEFAULT_ROWS),
 		serverAddr: serverAddr,
 		clientAddr: clientAddr,
 		username:   username,
 		title:      title,
 		Out:        out,
 		In:         in,
-		// TODO: no more hardcoding
-		delay:         1500 * time.Millisecond,
-		blockDuration: 1 * time.Second, // block size has to smaller than delay
+		queue:      newSendQueue(cfg.STREAMER_QUEUE_SIZE * 1024 * 1024),
+		session:    uuid.NewString(),
+		stdout:     newTermWriter(os.Stdout),
+		// changed with SetDelay
+		delay:         cfg.STREAMER_DEFAULT_DELAY * time.Millisecond,
+		blockDuration: cfg.STREAMER_DEFAULT_BLOCK * time.Millisecond, // block size has to smaller than delay
+		mode:          message.MBlock,
+		done:          make(chan struct{}),
+		closeSent:     make(chan struct{}),
 	}
 }
 
@@ -76,29 +121,110 @@ func (s *Streamer) SetKey(key string) {
 	s.key = key
 }
 
+// Record the session to a local file, in the same format rooms are recorded on server
+func (s *Streamer) SetRecordFile(path string) error {
+	recorder, err := record.NewRecorder(path)
+	if err != nil {
+		return err
+	}
+	s.localRecorder = recorder
+	return nil
+}
+
+// Delay viewers watch the stream with, output is sent in blocks of blockDuration
+// A short delay makes pairing smoother, a long one gives viewers a smoother stream
+func (s *Streamer) SetDelay(delay, blockDuration time.Duration) error {
+	if blockDuration > delay {
+		blockDuration = delay
+	}
+	min := cfg.ROOM_MIN_DELAY * time.Millisecond
+	max := cfg.ROOM_MAX_DELAY * time.Millisecond
+	if blockDuration < min || delay > max {
+		return fmt.Errorf("Delay and block duration must be between %s and %s", min, max)
+	}
+
+	s.delay = delay
+	s.blockDuration = blockDuration
+	return nil
+}
+
+func (s *Streamer) Delay() time.Duration {
+	return s.delay
+}
+
+// Send each write right away instead of in blocks with delay
+// Viewers see the terminal as it changes, but the stream isn't as smooth on slow connections
+func (s *Streamer) SetMode(mode message.StreamMode) {
+	s.mode = mode
+}
+
+// Stream a program instead of a shell
+func (s *Streamer) SetCommand(command []string) {
+	s.command = command
+}
+
+// Rewrite output before it's streamed, like masking secrets
+// Filters run in the order they're added
+func (s *Streamer) AddFilter(filter Filter) {
+	s.filters = append(s.filters, filter)
+}
+
+// Exit code of the streamed program
+func (s *Streamer) ExitCode() int {
+	return s.exitCode
+}
+
 func (s *Streamer) Start() error {
-	envVars := []string{fmt.Sprintf("%s=%s", cfg.STREAMER_ENVKEY_SESSIONID, s.username)}
-	s.pty.StartShell(envVars)
+	if s.offline && s.localRecorder == nil {
+		return fmt.Errorf("Offline mode requires a record file")
+	}
+
+	envVars := append([]string{
+		fmt.Sprintf("%s=%s", cfg.STREAMER_ENVKEY_SESSIONID, s.username),
+		fmt.Sprintf("%s=%d", cfg.STREAMER_ENVKEY_PID, os.Getpid()),
+	}, s.envVars...)
+	if s.tmux != nil {
+		if err := s.tmux.setPid(os.Getpid()); err != nil {
+			log.Printf("Failed to set pid in tmux session: %s", err)
+		}
+	}
+
+	var err error
+	if len(s.command) > 0 {
+		err = s.pty.StartCommand(s.command, envVars)
+	} else {
+		err = s.pty.StartShell(envVars)
+	}
+	if err != nil {
+		log.Printf("Failed to start pty: %s", err)
+		return err
+	}
 	fmt.Printf("Press Enter to continue!")
 	bufio.NewReader(os.Stdin).ReadString('\n')
 
 	// Init websocket connection
-	err := s.ConnectWS()
-	if err != nil {
-		log.Println(err)
-		fmt.Println(err.Error())
-		s.Stop(err.Error())
-		return err
+	if !s.offline {
+		err := s.ConnectWS()
+		if err != nil {
+			log.Println(err)
+			fmt.Println(err.Error())
+			s.Stop(err.Error())
+			return err
+		}
 	}
 
 	// Init transporter
-	s.recorder = NewRecorder(s.blockDuration, s.delay, s.Out)
+	if s.mode == message.MDirect {
+		s.recorder = NewDirectRecorder(cfg.STREAMER_DIRECT_COALESCE*time.Millisecond, s.Out)
+	} else {
+		s.recorder = NewRecorder(s.blockDuration, s.delay, s.Out)
+	}
 	go s.recorder.Start()
 
-	if s.private {
-		fmt.Printf("🔥 Streaming at: %s/%s?key=%s\n", s.clientAddr, s.username, s.key)
+	if s.offline {
+		fmt.Printf("📼 Recording offline at: %s\n", s.localRecorder.Path())
 	} else {
-		fmt.Printf("🔥 Streaming at: %s/%s\n", s.clientAddr, s.username)
+		s.printStreamingAddr()
 	}
 
 	s.pty.MakeRaw()
@@ -113,13 +239,25 @@ func (s *Streamer) Start() error {
 	})
 
 	// Pipe command response to Pty and server
+	// pty is closed once the program exits
+	// Only the stream goes through filters, the local terminal shows the real output
+	var stream io.Writer = s
+	var filterWriter *filterWriter
+	if len(s.filters) > 0 {
+		filterWriter = newFilterWriter(s, s.filters)
+		stream = filterWriter
+	}
+
+	outputDone := make(chan struct{})
 	go func() {
-		//mw := io.MultiWriter(os.Stdout, s, s.tr)
-		mw := io.MultiWriter(os.Stdout, s.recorder)
+		defer close(outputDone)
+		mw := io.MultiWriter(s.stdout, stream)
 		_, err := io.Copy(mw, s.pty.F())
 		if err != nil {
 			log.Printf("Failed to send pty to mw: %s", err)
-			s.Stop("Failed to connect pty with server\n")
+		}
+		if filterWriter != nil {
+			filterWriter.Flush()
 		}
 	}()
 
@@ -133,59 +271,161 @@ func (s *Streamer) Start() error {
 	}()
 
 	// Send message to server
-	go func() {
-		for {
-			msg, ok := <-s.Out
-			if !ok {
-				log.Printf("Error while getting message from Out chan")
-				continue
-			}
-			// TODO: Don't close pty when connection failed
-			// This make users lose their work while streaming
-			err := s.conn.WriteJSON(msg)
-			if err != nil {
-				log.Printf("Failed to send message. Streamer closing: %s", err)
-				time.Sleep(cfg.STREAMER_RETRY_CONNECT_AFTER * time.Second)
-				log.Printf("Reconnecting...")
-				err = s.ConnectWS()
-				if err != nil {
-					log.Printf("Failed to retry connection. Closing connection: %s", err)
-					s.Stop("Failed to connect with server! Please try again later\n")
-					return
-				}
-			}
+	s.sending.Add(1)
+	go s.sendLoop()
+
+	go s.snapshotLoop()
+
+	go s.pauseLoop()
+
+	s.pty.Wait() // Blocking until user exit
+	// tmux session keeps running after detaching, there is no exit to tell viewers
+	if len(s.command) == 0 || s.tmux != nil {
+		s.Stop("Bye!")
+		return nil
+	}
+
+	// Make sure viewers get the last output before the exit code
+	// Processes spawned by the program could keep pty open
+	select {
+	case <-outputDone:
+	case <-time.After(time.Second):
+	}
+	s.exitCode = s.pty.ExitCode()
+	s.sendClose()
+	s.Stop(fmt.Sprintf("%s exited with code %d", strings.Join(s.command, " "), s.exitCode))
+	return nil
+}
+
+// Tell viewers the program exited. Blocking until it's sent
+func (s *Streamer) sendClose() {
+	s.recorder.Send()
+	// the command line could have secrets too
+	command := []byte(strings.Join(s.command, " "))
+	for _, filter := range s.filters {
+		command = filter(command)
+	}
+	s.Out <- message.Wrapper{
+		Type: message.TClose,
+		Data: message.Close{Command: string(command), ExitCode: s.exitCode},
+	}
+	if s.offline {
+		return
+	}
+
+	select {
+	case <-s.closeSent:
+	case <-time.After(cfg.STREAMER_RETRY_CONNECT_AFTER * time.Second):
+	case <-s.done:
+	}
+}
+
+func (s *Streamer) handleServerMessage(msg message.Wrapper) {
+	switch msg.Type {
+
+	case message.TInput:
+		// Server only forwards input of viewers streamer granted control to
+		var data []byte
+		if err := message.ToStruct(msg.Data, &data); err != nil {
+			log.Printf("Failed to decode input: %s", err)
+			return
+		}
+		if _, err := s.pty.F().Write(data); err != nil {
+			log.Printf("Failed to write input to pty: %s", err)
 		}
-	}()
 
-	// Read and handle message from server
-	// Current for ping message only
-	go func() {
-		msg := message.Wrapper{}
-		err := s.conn.ReadJSON(&msg)
+	default:
 		log.Printf("Not implemented response for message: %s", msg.Type)
-		if err != nil {
-			log.Printf("Failed to receive message from server: %s", err)
+	}
+}
+
+// Write terminal output to stream
+func (s *Streamer) Write(data []byte) (int, error) {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	// keep the screen up to date so it can be sent on resume
+	s.emulator.Write(data)
+	if s.paused {
+		return len(data), nil
+	}
+	return s.recorder.Write(data)
+}
+
+// Periodically send a snapshot of the screen so viewers can fix their screen
+// without forcing apps of streamer to redraw
+func (s *Streamer) snapshotLoop() {
+	ticker := time.NewTicker(cfg.STREAMER_SNAPSHOT_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.writeSnapshot()
+		case <-s.done:
+			return
 		}
-	}()
+	}
+}
 
-	// Periodcally send a winsize msg to keep alive
-	go func() {
-		ticker := time.NewTicker(cfg.STREAMER_REFRESH_INTERVAL * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				log.Printf("refresh")
-				s.pty.Refresh()
+// Send the current screen unless paused
+// Holding pauseLock keeps Write from slipping output in between taking and sending the snapshot
+func (s *Streamer) writeSnapshot() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if s.paused {
+		return
+	}
+	s.recorder.WriteMsg(message.Wrapper{
+		Type: message.TSnapshot,
+		Data: s.emulator.Snapshot(),
+	})
+}
+
+func (s *Streamer) printStreamingAddr() {
+	if s.private {
+		fmt.Printf("🔥 Streaming at: %s/%s?key=%s\n", s.clientAddr, s.username, s.key)
+	} else {
+		fmt.Printf("🔥 Streaming at: %s/%s\n", s.clientAddr, s.username)
+	}
+}
+
+// Send messages in Out channel to server
+// Stopped when streamer is stopped, messages left in Out are recorded by Stop
+func (s *Streamer) sendLoop() {
+	defer s.sending.Done()
+	if !s.offline {
+		go s.connLoop()
+	}
+
+	for {
+		var msg message.Wrapper
+		select {
+		case msg = <-s.Out:
+		case <-s.done:
+			return
+		}
+
+		// Record before sending so the local copy is kept even if the connection drops
+		if s.localRecorder != nil {
+			if err := s.localRecorder.WriteMsg(msg); err != nil {
+				log.Printf("Failed to record message: %s", err)
 			}
 		}
-	}()
 
-	s.pty.Wait() // Blocking until user exit
-	s.Stop("Bye!")
-	return nil
+		if s.offline {
+			continue
+		}
+
+		// Sent by connLoop, it keeps messages until streamer is back online
+		if err := s.queue.Push(msg); err != nil {
+			log.Printf("Failed to queue message: %s", err)
+		}
+	}
 }
 
-func (s *Streamer) RequestAddRoom() int {
+// Return status code of server, or an error if server can't be reached
+// Server refuses to reset a room that is streaming unless replace is set
+func (s *Streamer) RequestAddRoom(replace bool) (int, error) {
 	body := map[string]string{"secret": s.secret, "key": s.key}
 	jsonValue, _ := json.Marshal(body)
 	payload := bytes.NewBuffer(jsonValue)
@@ -194,14 +434,18 @@ func (s *Streamer) RequestAddRoom() int {
 		"title":      {strings.TrimSpace(s.title)},
 		"version":    {cfg.STREAMER_VERSION},
 		"private":    {strconv.FormatBool(s.private)},
+		"delay":      {strconv.FormatInt(s.delay.Milliseconds(), 10)},
+		"mode":       {string(s.mode)},
+		"replace":    {strconv.FormatBool(replace)},
+		"session":    {s.session},
 	}
 
 	resp, err := http.Post(fmt.Sprintf("%s/api/room?%s", s.serverAddr, queries.Encode()), "application/json", payload)
 	if err != nil {
-		return 404
-	} else {
-		return resp.StatusCode
+		return 0, err
 	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
 }
 
 // When connect is initlialized, streamer send a client info to server
@@ -218,14 +462,15 @@ func (s *Streamer) ConnectWS() error {
 	log.Printf("Openning socket at %s", url.String())
 
 	conn, _, err := websocket.DefaultDialer.Dial(url.String(), nil)
-	s.conn = conn
 	if err != nil {
 		return fmt.Errorf("Failed to connect to server")
 	}
 
-	//Handle server ping
+	// Server pings periodically, connection is lost if it stops
+	conn.SetReadDeadline(time.Now().Add(cfg.STREAMER_PING_TIMEOUT * time.Second))
 	conn.SetPingHandler(func(appData string) error {
-		return s.conn.WriteControl(websocket.PongMessage, emptyByteArray, time.Time{})
+		conn.SetReadDeadline(time.Now().Add(cfg.STREAMER_PING_TIMEOUT * time.Second))
+		return conn.WriteControl(websocket.PongMessage, emptyByteArray, time.Time{})
 	})
 
 	// Handle server ping
@@ -241,30 +486,30 @@ func (s *Streamer) ConnectWS() error {
 		Secret: s.secret,
 	}
 
-	payload := message.Wrapper{
-		Type: message.TClientInfo,
-		Data: clientInfo,
-	}
-	err = conn.WriteJSON(payload)
-	if err != nil {
-		return fmt.Errorf("Failed to connect to server")
+	if _, err := handshake(conn, clientInfo, true); err != nil {
+		conn.Close()
+		return err
 	}
 
-	// Verify server's response
-	msg := message.Wrapper{}
-	err = conn.ReadJSON(&msg)
-	if msg.Type == message.TUnauthorized {
-		return fmt.Errorf("Unauthorized connection")
-	} else if msg.Type != message.TAuthorized {
-		return fmt.Errorf("Expect connect confirmation from server")
-	}
+	s.connLock.Lock()
+	s.conn = conn
+	s.connLock.Unlock()
 	return nil
 }
 
 func (s *Streamer) Stop(msg string) {
-	if s.conn != nil {
-		s.conn.WriteControl(websocket.CloseMessage, emptyByteArray, time.Time{})
-		s.conn.Close()
+	// Messages that haven't been sent yet are still part of the session
+	if s.localRecorder != nil && s.recorder != nil {
+		s.recorder.Send()
+	}
+
+	s.stopOnce.Do(func() { close(s.done) })
+	// Only drain Out once sendLoop is stopped so each message is recorded once and in order
+	s.sending.Wait()
+
+	if conn := s.wsConn(); conn != nil {
+		conn.WriteControl(websocket.CloseMessage, emptyByteArray, time.Time{})
+		conn.Close()
 	}
 
 	if s.pty != nil {
@@ -272,6 +517,28 @@ func (s *Streamer) Stop(msg string) {
 		s.pty.Restore()
 	}
 
+	if s.tmux != nil {
+		s.tmux.unsetPid()
+	}
+
+	if s.localRecorder != nil {
+	drain:
+		for {
+			select {
+			case msg := <-s.Out:
+				if err := s.localRecorder.WriteMsg(msg); err != nil {
+					log.Printf("Failed to record message: %s", err)
+				}
+			default:
+				break drain
+			}
+		}
+		if err := s.localRecorder.Close(); err != nil {
+			log.Printf("Failed to close local recording: %s", err)
+		}
+	}
+
+	s.stdout.RestoreTitle()
 	fmt.Println()
 	fmt.Println(msg)
 }
@@ -282,8 +549,12 @@ func (s *Streamer) writeWinsize(rows, cols uint16) {
 		Data: message.Winsize{Rows: rows, Cols: cols},
 	}
 
+	s.emulator.Resize(int(cols), int(rows))
 	s.recorder.WriteMsg(msg)
 
 	// send to server so server can easily save it as last winsize
-	s.Out <- msg
+	// direct recorder already sent it
+	if s.mode != message.MDirect {
+		s.Out <- msg
+	}
 }
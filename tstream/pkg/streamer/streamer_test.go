@@ -0,0 +1,141 @@
+package streamer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Streamer in direct mode without a pty or a server, messages it sends are left in Out
+func newTestStreamer() *Streamer {
+	s := &Streamer{
+		username:  "test",
+		secret:    "secret",
+		session:   "session",
+		emulator:  emulator.New(emulator.DEFAULT_COLS, emulator.DEFAULT_ROWS),
+		Out:       make(chan message.Wrapper, 256),
+		mode:      message.MDirect,
+		stdout:    newTermWriter(ioutil.Discard),
+		done:      make(chan struct{}),
+		closeSent: make(chan struct{}),
+	}
+	s.recorder = NewDirectRecorder(time.Millisecond, s.Out)
+	return s
+}
+
+// Read what streamer sent until a message of msgType
+func nextOut(t *testing.T, s *Streamer, msgType message.MType) message.Wrapper {
+	t.Helper()
+	for {
+		select {
+		case msg := <-s.Out:
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Streamer didn't send %s", msgType)
+		}
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	s := newTestStreamer()
+	s.Write([]byte("\x1b[1mhello\x1b[0m"))
+	s.writeSnapshot()
+
+	// output written before the snapshot is sent before it
+	if data := writeData(t, nextOut(t, s, message.TWrite)); data != "\x1b[1mhello\x1b[0m" {
+		t.Errorf("Got %q, want the output first", data)
+	}
+	snapshot := message.Snapshot{}
+	if err := message.ToStruct(nextOut(t, s, message.TSnapshot).Data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Cols != emulator.DEFAULT_COLS || snapshot.Rows != emulator.DEFAULT_ROWS || !bytes.Contains(snapshot.Data, []byte("hello")) {
+		t.Errorf("Got a %dx%d snapshot %q, want the screen of streamer", snapshot.Cols, snapshot.Rows, snapshot.Data)
+	}
+}
+
+// Viewers are told how the program exited after its last output
+func TestSendClose(t *testing.T) {
+	s := newTestStreamer()
+	s.offline = true
+	s.SetCommand([]string{"deploy", "--token", "hunter2"})
+	s.AddFilter(func(data []byte) []byte {
+		return bytes.ReplaceAll(data, []byte("hunter2"), []byte("*******"))
+	})
+	s.exitCode = 3
+	s.Write([]byte("deployed"))
+	s.sendClose()
+
+	if data := writeData(t, nextOut(t, s, message.TWrite)); data != "deployed" {
+		t.Errorf("Got %q, want the output first", data)
+	}
+	closeMsg := message.Close{}
+	if err := message.ToStruct(nextOut(t, s, message.TClose).Data, &closeMsg); err != nil {
+		t.Fatal(err)
+	}
+	if closeMsg.Command != "deploy --token *******" || closeMsg.ExitCode != 3 {
+		t.Errorf("Got %q exited with %d, want the filtered command with code 3", closeMsg.Command, closeMsg.ExitCode)
+	}
+}
+
+// `tstream pause` hides output from viewers, `tstream resume` shows them the screen they missed
+func TestPauseSignal(t *testing.T) {
+	// signals reaching the test before pauseLoop listens would kill it
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, PAUSE_SIGNAL, RESUME_SIGNAL)
+	defer signal.Stop(ignored)
+
+	s := newTestStreamer()
+	go s.pauseLoop()
+	defer close(s.done)
+
+	signalUntil := func(sig syscall.Signal, paused bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.Paused() != paused {
+			if time.Now().After(deadline) {
+				t.Fatalf("Streamer didn't handle %s", sig)
+			}
+			syscall.Kill(os.Getpid(), sig)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	signalUntil(PAUSE_SIGNAL, true)
+	s.Write([]byte("private"))
+	s.writeSnapshot()
+	signalUntil(RESUME_SIGNAL, false)
+
+	var got []message.MType
+	snapshot := message.Snapshot{}
+	for len(got) < 3 {
+		select {
+		case msg := <-s.Out:
+			got = append(got, msg.Type)
+			if msg.Type == message.TWrite {
+				t.Errorf("Got %q while paused", writeData(t, msg))
+			} else if msg.Type == message.TSnapshot {
+				message.ToStruct(msg.Data, &snapshot)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Got %v, want pause, snapshot and resume", got)
+		}
+	}
+	if want := []message.MType{message.TPause, message.TSnapshot, message.TPause}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	// screen is kept up to date while paused
+	if !bytes.Contains(snapshot.Data, []byte("private")) {
+		t.Errorf("Got snapshot %q, want the screen after pause", snapshot.Data)
+	}
+}
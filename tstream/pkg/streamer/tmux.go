@@ -0,0 +1,93 @@
+/*
+Stream a tmux session that is already running.
+Streamer runs a read-only tmux client in its pty, so the session keeps running
+after the stream ends and work in progress doesn't have to be restarted.
+Keep working in your own tmux client, the streamed one only mirrors it
+*/
+package streamer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/qnkhuat/tstream/internal/cfg"
+)
+
+type tmuxSession struct {
+	socket []string // flags to reach the tmux server
+	name   string
+}
+
+func (t *tmuxSession) command(args ...string) *exec.Cmd {
+	return exec.Command("tmux", append(append([]string{}, t.socket...), args...)...)
+}
+
+// Panes are started by tmux server instead of streamer, so they don't have TSTREAM_PID
+// Keep it in the session environment where `tstream pause` looks for it
+func (t *tmuxSession) setPid(pid int) error {
+	return t.command("set-environment", "-t", t.name, cfg.STREAMER_ENVKEY_PID, strconv.Itoa(pid)).Run()
+}
+
+func (t *tmuxSession) unsetPid() error {
+	return t.command("set-environment", "-u", "-t", t.name, cfg.STREAMER_ENVKEY_PID).Run()
+}
+
+// Flags to attach a client that can't type into the session.
+// Since tmux 3.2 it also doesn't shrink windows to its size for the other clients
+func tmuxAttachFlags(version string) []string {
+	// prints "tmux 3.3a", or "tmux next-3.4" for builds from source
+	var major, minor int
+	fields := strings.Fields(version)
+	if len(fields) == 2 {
+		fmt.Sscanf(strings.TrimPrefix(fields[1], "next-"), "%d.%d", &major, &minor)
+	}
+	if major > 3 || (major == 3 && minor >= 2) {
+		return []string{"-f", "read-only,ignore-size"}
+	}
+	return []string{"-r"}
+}
+
+// Stream a read-only tmux client attached to target, a session name or a pane like work:1.2
+// Detaching the client stops the stream
+func (s *Streamer) AttachTmux(target string) error {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return fmt.Errorf("tmux is not installed")
+	}
+
+	session := &tmuxSession{}
+	// inside tmux, TMUX is "socket,pid,session". Keep using the same server
+	if env := os.Getenv("TMUX"); env != "" {
+		session.socket = []string{"-S", strings.Split(env, ",")[0]}
+	}
+
+	name, err := session.command("display-message", "-p", "-t", target, "#{session_name}").Output()
+	if err != nil {
+		return fmt.Errorf("tmux session %s not found", target)
+	}
+	session.name = strings.TrimSpace(string(name))
+	s.tmux = session
+
+	version, _ := exec.Command("tmux", "-V").Output()
+	attach := append(append([]string{"tmux"}, session.socket...), "attach-session")
+	attach = append(append(attach, tmuxAttachFlags(string(version))...), "-t", target)
+	s.SetCommand(attach)
+	// tmux refuses to attach from inside a tmux session unless TMUX is empty
+	s.envVars = append(s.envVars, "TMUX=")
+	return nil
+}
+
+// Pid of streamer streaming the tmux session this process runs in, empty if there's none
+func tmuxPid() string {
+	if os.Getenv("TMUX") == "" {
+		return ""
+	}
+	// prints KEY=value, or -KEY once it's unset
+	out, err := exec.Command("tmux", "show-environment", cfg.STREAMER_ENVKEY_PID).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(out)), cfg.STREAMER_ENVKEY_PID+"=")
+}
@@ -0,0 +1,25 @@
+package streamer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTmuxAttachFlags(t *testing.T) {
+	tests := []struct {
+		version string
+		flags   []string
+	}{
+		{"tmux 3.3a", []string{"-f", "read-only,ignore-size"}},
+		{"tmux 3.2", []string{"-f", "read-only,ignore-size"}},
+		{"tmux next-3.4", []string{"-f", "read-only,ignore-size"}},
+		{"tmux 3.1c", []string{"-r"}},
+		{"tmux 2.9", []string{"-r"}},
+		{"", []string{"-r"}},
+	}
+	for _, tt := range tests {
+		if flags := tmuxAttachFlags(tt.version); !reflect.DeepEqual(flags, tt.flags) {
+			t.Errorf("%q: got %v, want %v", tt.version, flags, tt.flags)
+		}
+	}
+}
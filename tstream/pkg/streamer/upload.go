@@ -0,0 +1,129 @@
+/*
+Upload sessions recorded while offline.
+Server creates a stopped room with the recording attached so it can be replayed and exported like any other session
+*/
+package streamer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qnkhuat/tstream/internal/cfg"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+)
+
+// Default directory to keep sessions recorded while offline
+var RECORD_DIR = os.ExpandEnv("$HOME/.tstream-records")
+
+// Path to record an offline session started now
+func DefaultRecordPath() string {
+	return filepath.Join(RECORD_DIR, fmt.Sprintf("%d.gz", time.Now().Unix()))
+}
+
+func (s *Streamer) SetOffline(offline bool) {
+	s.offline = offline
+}
+
+func (s *Streamer) Offline() bool {
+	return s.offline
+}
+
+// Path of the local recording. Empty if streamer isn't recording
+func (s *Streamer) RecordFile() string {
+	if s.localRecorder == nil {
+		return ""
+	}
+	return s.localRecorder.Path()
+}
+
+// Upload a recording made by streamer
+// retry is true if server couldn't be reached, in which case it's worth trying again later
+func (s *Streamer) Upload(path string) (info message.RoomInfo, retry bool, err error) {
+	recording, err := os.Open(path)
+	if err != nil {
+		return info, false, err
+	}
+	defer recording.Close()
+
+	// Stream the form instead of loading the whole recording in memory
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(form, s.secret, path, recording))
+	}()
+
+	queries := url.Values{
+		"streamerID": {s.username},
+		"title":      {strings.TrimSpace(s.title)},
+		"version":    {cfg.STREAMER_VERSION},
+		"delay":      {strconv.FormatInt(s.delay.Milliseconds(), 10)},
+		"mode":       {string(s.mode)},
+	}
+	resp, err := http.Post(fmt.Sprintf("%s/api/room/upload?%s", s.serverAddr, queries.Encode()), form.FormDataContentType(), pr)
+	if err != nil {
+		pr.Close()
+		return info, true, fmt.Errorf("Failed to connect to server")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return info, false, fmt.Errorf("Failed to upload: %s", strings.TrimSpace(string(msg)))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, false, err
+}
+
+// Keep trying to upload a recording until server is reachable. Blocking call
+func (s *Streamer) UploadWhenOnline(path string) (message.RoomInfo, error) {
+	for {
+		info, retry, err := s.Upload(path)
+		if !retry {
+			return info, err
+		}
+		log.Printf("Failed to upload %s: %s", path, err)
+		fmt.Printf("Server is unreachable. Retry uploading in %d seconds. Press Ctrl-C to upload later with: tstream upload %s\n", cfg.STREAMER_RETRY_CONNECT_AFTER, path)
+		time.Sleep(cfg.STREAMER_RETRY_CONNECT_AFTER * time.Second)
+	}
+}
+
+func writeUploadForm(form *multipart.Writer, secret, path string, recording io.Reader) error {
+	if err := form.WriteField("secret", secret); err != nil {
+		return err
+	}
+
+	part, err := form.CreateFormFile("record", filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, recording); err != nil {
+		return err
+	}
+
+	// Index is optional, server can replay without it
+	if index, err := os.Open(record.IndexPath(path)); err == nil {
+		defer index.Close()
+		part, err := form.CreateFormFile("index", filepath.Base(index.Name()))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, index); err != nil {
+			return err
+		}
+	}
+
+	return form.Close()
+}
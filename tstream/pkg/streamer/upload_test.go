@@ -0,0 +1,112 @@
+package streamer
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/record"
+)
+
+// Streamer recording offline, without a pty
+func offlineStreamer(t *testing.T, path string) *Streamer {
+	s := newTestStreamer()
+	s.title = "offline"
+	s.offline = true
+	if err := s.SetRecordFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Record messages the way streamer does while offline
+func recordOffline(t *testing.T, s *Streamer, writes ...string) {
+	t.Helper()
+	// messages still in Out when streamer stops are recorded too
+	s.sending.Add(1)
+	go s.sendLoop()
+	for _, data := range writes {
+		s.Out <- message.Wrapper{Type: message.TWrite, Data: []byte(data)}
+	}
+	s.Stop("")
+}
+
+func TestRecordOffline(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	path := filepath.Join(t.TempDir(), "session.gz")
+	recordOffline(t, offlineStreamer(t, path), "one", "two", "three")
+
+	reader, err := record.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		msg, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, writeData(t, msg))
+	}
+	reader.Close()
+	if len(got) != 3 || got[0] != "one" || got[1] != "two" || got[2] != "three" {
+		t.Fatalf("Recorded %v, want one, two and three", got)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	path := filepath.Join(t.TempDir(), "session.gz")
+	s := offlineStreamer(t, path)
+	recordOffline(t, s, "one", "two", "three")
+
+	// server gets the recording and its index as they are on disk
+	recording, _ := ioutil.ReadFile(path)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/api/room/upload" || q.Get("streamerID") != "test" || q.Get("mode") != string(message.MDirect) {
+			t.Errorf("Got upload to %s", r.URL)
+		}
+		if r.FormValue("secret") != "secret" {
+			t.Errorf("Got secret %q", r.FormValue("secret"))
+		}
+		for _, field := range []string{"record", "index"} {
+			f, _, err := r.FormFile(field)
+			if err != nil {
+				t.Errorf("Missing %s: %s", field, err)
+				continue
+			}
+			data, _ := ioutil.ReadAll(f)
+			if field == "record" && string(data) != string(recording) {
+				t.Errorf("Got a recording of %d bytes, want %d", len(data), len(recording))
+			}
+		}
+		if q.Get("title") == "taken" {
+			http.Error(w, "Username is taken", 401)
+			return
+		}
+		json.NewEncoder(w).Encode(message.RoomInfo{Id: 7, StreamerID: "test"})
+	}))
+	defer server.Close()
+
+	s.serverAddr = server.URL
+	if info, retry, err := s.Upload(path); err != nil || retry || info.Id != 7 {
+		t.Errorf("Got room %d, retry %t: %v, want room 7", info.Id, retry, err)
+	}
+	s.title = "taken"
+	if _, retry, err := s.Upload(path); err == nil || retry {
+		t.Errorf("Got retry %t: %v, want a rejected upload not retried", retry, err)
+	}
+	s.serverAddr = "http://127.0.0.1:1"
+	if _, retry, err := s.Upload(path); err == nil || !retry {
+		t.Errorf("Got retry %t: %v, want an unreachable server retried", retry, err)
+	}
+}
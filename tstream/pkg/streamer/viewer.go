@@ -0,0 +1,121 @@
+/*
+Watch a stream from terminal.
+Blocks are rendered with the same delay the web client uses
+into an emulated screen, shown next to the chat of the room
+*/
+package streamer
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/qnkhuat/tstream/pkg/message"
+	"github.com/qnkhuat/tstream/pkg/viewer"
+	"github.com/rivo/tview"
+)
+
+// width of the chat pane in columns
+const VIEWER_CHAT_WIDTH = 40
+
+type Viewer struct {
+	chat     *Chat
+	key      string // key to access if room is private
+	renderer *viewer.Renderer
+	termView *viewer.TermView
+}
+
+func NewViewer(serverAddr, roomName, username, key string) *Viewer {
+	chat := NewChat(roomName, serverAddr, username)
+	chat.role = message.RViewer
+	chat.color = "green"
+
+	emu := emulator.New(emulator.DEFAULT_COLS, emulator.DEFAULT_ROWS)
+	return &Viewer{
+		chat:     chat,
+		key:      key,
+		renderer: viewer.NewRenderer(emu, func() { chat.app.QueueUpdateDraw(func() {}) }),
+		termView: viewer.NewTermView(emu),
+	}
+}
+
+// Blocking until viewer exits or the stream is stopped
+func (v *Viewer) Start() error {
+	conn, err := v.connectWS()
+	if err != nil {
+		log.Printf("Failed to connect to server: %s", err)
+		return err
+	}
+	defer conn.Close()
+
+	v.termView.SetBorder(true).SetTitle(fmt.Sprintf(" @%s ", v.chat.sessionId))
+	layout := tview.NewFlex().
+		AddItem(v.termView, 0, 1, false).
+		AddItem(v.chat.newLayout(), VIEWER_CHAT_WIDTH, 0, true)
+	v.chat.app.SetRoot(layout, true)
+
+	v.chat.wsConn = conn
+	v.chat.onMessage = v.handleMessage
+	go v.renderer.Start()
+	defer v.renderer.Stop()
+	v.chat.startService()
+	v.chat.requestServer(message.TRequestWinsize)
+	v.chat.requestServer(message.TRequestCacheContent)
+
+	// blocking call
+	if err := v.chat.app.EnableMouse(true).Run(); err != nil {
+		log.Printf("Error in UI app: %s", err)
+		return err
+	}
+	return nil
+}
+
+// Viewers of public rooms are accepted right away,
+// private rooms confirm whether the key is correct
+func (v *Viewer) connectWS() (*websocket.Conn, error) {
+	url := getWSUrl(v.chat.serverAddr, v.chat.sessionId)
+	log.Printf("Openning socket at %s", url)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to room %s", v.chat.sessionId)
+	}
+
+	clientInfo := message.ClientInfo{
+		Name:         v.chat.username,
+		Role:         message.RViewer,
+		Key:          v.key,
+		Encoding:     message.EBinary,
+		Capabilities: []message.Capability{message.CBinary, message.CDirect},
+	}
+	if _, err := handshake(conn, clientInfo, v.key != ""); err != nil {
+		conn.Close()
+		if err == errUnauthorized {
+			return nil, fmt.Errorf("Unauthorized. Please check the room key")
+		}
+		return nil, err
+	}
+
+	conn.SetPingHandler(func(appData string) error {
+		return conn.WriteControl(websocket.PongMessage, []byte{}, time.Time{})
+	})
+	return conn, nil
+}
+
+func (v *Viewer) handleMessage(msg message.Wrapper) {
+	switch msg.Type {
+
+	case message.TWriteBlock, message.TWinsize, message.TWrite, message.TSnapshot, message.TPause:
+		if err := v.renderer.WriteMsg(msg); err != nil {
+			log.Printf("Failed to render message: %s", err)
+		}
+
+	case message.TRoomInfo:
+		roomInfo := message.RoomInfo{}
+		if err := message.ToStruct(msg.Data, &roomInfo); err == nil {
+			v.renderer.SetDelay(time.Duration(roomInfo.Delay) * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ttyrec file format
+A file is a sequence of frames. Each frame is a 12 bytes header followed by the output data
+Header contains 3 little endian uint32: seconds, microseconds and length of data
+*/
+package ttyrec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Frames are what a terminal program wrote at once, far smaller than this in practice
+// Length in header is not trusted to be sane, a corrupted file could ask for 4GB
+const MAX_FRAME_SIZE = 1 << 20
+
+type Frame struct {
+	Time time.Time
+	Data []byte
+}
+
+type Reader struct {
+	r io.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Return io.EOF when there is no frame left
+func (r *Reader) Next() (Frame, error) {
+	frame := Frame{}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("Frame header is truncated")
+		}
+		return frame, err
+	}
+
+	sec := binary.LittleEndian.Uint32(header[0:4])
+	usec := binary.LittleEndian.Uint32(header[4:8])
+	length := binary.LittleEndian.Uint32(header[8:12])
+
+	if length > MAX_FRAME_SIZE {
+		return frame, fmt.Errorf("Frame is too large: %d bytes", length)
+	}
+
+	frame.Time = time.Unix(int64(sec), int64(usec)*int64(time.Microsecond))
+	frame.Data = make([]byte, length)
+	if _, err := io.ReadFull(r.r, frame.Data); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = fmt.Errorf("Frame is truncated, got less than %d bytes", length)
+		}
+		return frame, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,45 @@
+package ttyrec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func header(sec, usec, length uint32) []byte {
+	h := make([]byte, 12)
+	binary.LittleEndian.PutUint32(h[0:4], sec)
+	binary.LittleEndian.PutUint32(h[4:8], usec)
+	binary.LittleEndian.PutUint32(h[8:12], length)
+	return h
+}
+
+func TestNext(t *testing.T) {
+	data := append(header(1, 500000, 5), "hello"...)
+	r := NewReader(bytes.NewReader(data))
+
+	frame, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.Data) != "hello" || frame.Time.UnixNano() != 1500000000 {
+		t.Errorf("Got frame %q at %s", frame.Data, frame.Time)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Got %v after last frame, want io.EOF", err)
+	}
+}
+
+func TestNextBroken(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"truncated header": header(1, 0, 5)[:6],
+		"truncated data":   append(header(1, 0, 5), "hel"...),
+		"no data":          header(1, 0, 5),
+		"too large":        header(1, 0, MAX_FRAME_SIZE+1),
+	} {
+		if _, err := NewReader(bytes.NewReader(data)).Next(); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, want an error", name, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package viewer
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/qnkhuat/tstream/pkg/message"
+)
+
+// Default delay of rooms, used until viewers get room info
+const DEFAULT_DELAY = 1500 * time.Millisecond
+
+// Render blocks to an emulated screen with the same delay the web client uses
+type Renderer struct {
+	lock sync.Mutex
+
+	emulator *emulator.Emulator
+
+	// called when the screen changed and should be drawn
+	onRender func()
+
+	// delay of room
+	delay time.Duration
+
+	// messages scheduled to be rendered, one entry per block
+	queue chan []scheduledMsg
+	done  chan struct{}
+	once  sync.Once
+}
+
+type scheduledMsg struct {
+	renderTime time.Time
+	msg        message.Wrapper
+}
+
+func NewRenderer(emu *emulator.Emulator, onRender func()) *Renderer {
+	return &Renderer{
+		emulator: emu,
+		onRender: onRender,
+		delay:    DEFAULT_DELAY,
+		queue:    make(chan []scheduledMsg, 256),
+		done:     make(chan struct{}),
+	}
+}
+
+func (re *Renderer) SetDelay(delay time.Duration) {
+	re.lock.Lock()
+	re.delay = delay
+	re.lock.Unlock()
+}
+
+// Handle a message streamed to viewers
+// Blocks are scheduled, other messages are applied right away
+func (re *Renderer) WriteMsg(msg message.Wrapper) error {
+	switch msg.Type {
+
+	case message.TWriteBlock:
+		block, err := message.ToTermWriteBlock(msg.Data)
+		if err != nil {
+			return err
+		}
+		return re.AddBlock(block)
+
+	case message.TWinsize, message.TWrite, message.TSnapshot, message.TPause:
+		if err := re.emulator.WriteMsg(msg); err != nil {
+			return err
+		}
+		re.onRender()
+	}
+	return nil
+}
+
+func (re *Renderer) AddBlock(block message.TermWriteBlock) error {
+	msgs, err := message.DecodeBlock(block)
+	if err != nil {
+		return err
+	}
+
+	// Render time of a message is relative to when its block started plus the delay of room
+	re.lock.Lock()
+	offset := time.Since(block.StartTime.Add(re.delay))
+	re.lock.Unlock()
+
+	scheduled := make([]scheduledMsg, len(msgs))
+	for i, msg := range msgs {
+		delay := time.Duration(msg.Delay)*time.Millisecond - offset
+		scheduled[i] = scheduledMsg{renderTime: time.Now().Add(delay), msg: msg}
+	}
+
+	select {
+	case re.queue <- scheduled:
+	case <-re.done:
+	}
+	return nil
+}
+
+// Render messages at their scheduled time. Blocking until stopped
+func (re *Renderer) Start() {
+	for {
+		var msgs []scheduledMsg
+		select {
+		case msgs = <-re.queue:
+		case <-re.done:
+			return
+		}
+
+		for i, scheduled := range msgs {
+			select {
+			case <-time.After(time.Until(scheduled.renderTime)):
+			case <-re.done:
+				return
+			}
+
+			if err := re.emulator.WriteMsg(scheduled.msg); err != nil {
+				log.Printf("Failed to render message: %s", err)
+			}
+
+			// Draw once for all messages that are due
+			if i == len(msgs)-1 || time.Until(msgs[i+1].renderTime) > 0 {
+				re.onRender()
+			}
+		}
+	}
+}
+
+func (re *Renderer) Stop() {
+	re.once.Do(func() { close(re.done) })
+}
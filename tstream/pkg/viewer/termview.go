@@ -0,0 +1,74 @@
+/*
+Render a stream in a terminal UI.
+Used by terminal viewers: `tstream watch` and the SSH gateway of server
+*/
+package viewer
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/qnkhuat/tstream/pkg/emulator"
+	"github.com/rivo/tview"
+)
+
+// Shown instead of the screen while streamer paused the stream
+const AWAY_TEXT = "⏸ Streamer is away, be right back"
+
+// Show an emulated terminal screen
+type TermView struct {
+	*tview.Box
+	emulator *emulator.Emulator
+}
+
+func NewTermView(emu *emulator.Emulator) *TermView {
+	return &TermView{
+		Box:      tview.NewBox(),
+		emulator: emu,
+	}
+}
+
+func (t *TermView) Draw(screen tcell.Screen) {
+	t.Box.DrawForSubclass(screen, t)
+	x0, y0, width, height := t.GetInnerRect()
+
+	if t.emulator.Paused() {
+		tview.Print(screen, AWAY_TEXT, x0, y0+height/2, width, tview.AlignCenter, tcell.ColorYellow)
+		return
+	}
+
+	cells := t.emulator.Cells()
+	cursorX, cursorY, cursorVisible := t.emulator.Cursor()
+
+	// Screen bigger than the view is cropped
+	for y := 0; y < height && y < len(cells); y++ {
+		for x := 0; x < width && x < len(cells[y]); x++ {
+			cell := cells[y][x]
+			style := cellStyle(cell)
+			if cursorVisible && x == cursorX && y == cursorY {
+				style = style.Reverse(!cell.Reverse)
+			}
+
+			ch := cell.Char
+			if ch == 0 {
+				ch = ' '
+			}
+			screen.SetContent(x0+x, y0+y, ch, nil, style)
+		}
+	}
+}
+
+func cellStyle(cell emulator.Cell) tcell.Style {
+	style := tcell.StyleDefault.
+		Bold(cell.Bold).
+		Italic(cell.Italic).
+		Underline(cell.Underline).
+		Blink(cell.Blink).
+		Reverse(cell.Reverse)
+
+	if cell.FG >= 0 {
+		style = style.Foreground(tcell.PaletteColor(cell.FG))
+	}
+	if cell.BG >= 0 {
+		style = style.Background(tcell.PaletteColor(cell.BG))
+	}
+	return style
+}